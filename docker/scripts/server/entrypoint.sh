@@ -115,7 +115,8 @@ log INFO "Setting up quota"
 btrfs quota enable "$MOUNTPOINT"
 
 log INFO "Getting my container id"
-export CONTAINER_ID=$(cat /proc/self/mountinfo | grep -m1 -oE 'docker/containers/([a-f0-9]+)/' | xargs basename)
+# docker and podman expose the container id in different mount paths
+export CONTAINER_ID=${CONTAINER_ID:-$(cat /proc/self/mountinfo | grep -m1 -oE '(docker/containers|overlay-containers)/([a-f0-9]+)/' | xargs basename)}
 log INFO "My container id is $CONTAINER_ID"
 
 # Set up signal handling
@@ -5,18 +5,16 @@ cd "$CREATING_WORKSPACE"
 chmod 777 "$CREATING_WORKSPACE"
 chmod 1777 /tmp
 
-# Allow all traffic to Docker's DNS (127.0.0.11) regardless of port
-iptables -A OUTPUT -m owner --uid-owner $CREATING_USER -d 127.0.0.11 -j ACCEPT
+# Without NET_ADMIN the container runs in an isolated network and egress is
+# enforced by the gateways on that network instead
+if iptables -L OUTPUT >/dev/null 2>&1; then
+    # Allow all traffic to Docker's DNS (127.0.0.11) regardless of port
+    iptables -A OUTPUT -m owner --uid-owner $CREATING_USER -d 127.0.0.11 -j ACCEPT
 
-# Your existing proxy and reject rules
-iptables -A OUTPUT -m owner --uid-owner $CREATING_USER -p tcp --dport 3128 -j ACCEPT
-iptables -A OUTPUT -m owner --uid-owner $CREATING_USER -j REJECT
-ip6tables -A OUTPUT -m owner --uid-owner $CREATING_USER -j REJECT
-
-# First, copy all files including hidden ones
-if ! rsync -r --chown="${CREATING_USER}:${CREATING_USER}" /templates/ "$CREATING_WORKSPACE"; then
-    echo "Failed to copy template files to workspace"
-    exit 1
+    # Your existing proxy and reject rules
+    iptables -A OUTPUT -m owner --uid-owner $CREATING_USER -p tcp --dport 3128 -j ACCEPT
+    iptables -A OUTPUT -m owner --uid-owner $CREATING_USER -j REJECT
+    ip6tables -A OUTPUT -m owner --uid-owner $CREATING_USER -j REJECT
 fi
 
 touch /tmp/.init
@@ -13,7 +13,8 @@ export NODE_PATH=$HOME/nvm/v$NODE_VERSION/lib/node_modules
 export EDITOR=nvim
 export VISUAL=nvim
 
-if [ -z "${IS_DEV_ENV}" ]; then
+# the built-in egress proxy of the server sets the variables with credentials
+if [ -z "${IS_DEV_ENV}" ] && [ -z "${HTTP_PROXY}" ]; then
 export http_proxy=http://proxy:3128
 export https_proxy=http://proxy:3128
 export no_proxy=localhost,proxy
@@ -1,15 +1,30 @@
 #!/bin/bash
+# Shows the usage and limits of this container. `ssh <host> :stats` prints the
+# same from the server, including network IO and the disk quota.
+
+cgroup=/sys/fs/cgroup
+
+limit() {
+    if [ ! -r "$1" ] || [ "$(cat "$1")" = "max" ]; then
+        echo "no limit"
+    else
+        numfmt --to=iec "$(cat "$1")"
+    fi
+}
 
 echo "Resource Usage for $USER:"
 echo "------------------------"
-echo "Memory Usage:"
-free -h
+echo "Memory: $(numfmt --to=iec "$(cat "$cgroup/memory.current")") of $(limit "$cgroup/memory.max")"
 
-echo -e "\nCPU Usage:"
-top -b -n 1 -u "$USER" | head -n 12
+read -r quota period < "$cgroup/cpu.max"
+if [ "$quota" = "max" ]; then
+    echo "CPU limit: no limit"
+else
+    echo "CPU limit: $(awk "BEGIN { print $quota / $period }") CPUs"
+fi
 
-echo -e "\nDisk Usage:"
-df -h /workspaces/"$USER"
+pids_max=$(cat "$cgroup/pids.max")
+echo "Processes: $(cat "$cgroup/pids.current") of ${pids_max/max/no limit}"
 
-echo -e "\nProcess Count:"
-ps -u "$USER" | wc -l
+echo -e "\nDisk Usage:"
+df -h "$(dirname "$(readlink -f "$0")")"
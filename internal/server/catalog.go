@@ -0,0 +1,328 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImageEnv selects a catalog entry if none is given in the login name
+const ImageEnv = "SSHCONTAINER_IMAGE"
+
+// CatalogEntry describes an image users can choose for their workspace
+type CatalogEntry struct {
+	Name      string      `json:"name"`
+	Image     string      `json:"image"`
+	Cmd       []string    `json:"cmd"`
+	User      string      `json:"user"`
+	MountPath string      `json:"mountPath"`
+	Groups    []string    `json:"groups"`
+	Pool      *PoolConfig `json:"pool,omitempty"`
+	Rollout   *Rollout    `json:"rollout,omitempty"`
+	// Template is a directory or tarball seeded into new workspaces, owned by TemplateOwner
+	Template      string `json:"template,omitempty"`
+	TemplateOwner string `json:"templateOwner,omitempty"`
+	// SecurityProfile overrides the security profile of the user's resource profile
+	SecurityProfile string `json:"securityProfile,omitempty"`
+	// Pinned maps users to the image they keep regardless of rollouts
+	Pinned map[string]string `json:"pinned,omitempty"`
+
+	// ImageID is the ID of the local image, resolved when the image is prepared
+	ImageID string `json:"-"`
+}
+
+// Rollout ships a new image to a stable share of the users of an entry
+type Rollout struct {
+	Image   string `json:"image"`
+	Percent int    `json:"percent"`
+}
+
+// ImageFor returns the image the user runs: a pinned image, the rollout image
+// if the user falls into the rollout share, or the image of the entry.
+func (e CatalogEntry) ImageFor(user string) string {
+	if image, pinned := e.Pinned[user]; pinned {
+		return image
+	}
+	if e.Rollout != nil && rolloutBucket(e.Name, user) < e.Rollout.Percent {
+		return e.Rollout.Image
+	}
+	return e.Image
+}
+
+// rolloutBucket places the user in one of 100 buckets. Users keep their bucket
+// while the percentage grows, so nobody switches back and forth.
+func rolloutBucket(entry, user string) int {
+	h := fnv.New32a()
+	h.Write([]byte(entry + "/" + user))
+	return int(h.Sum32() % 100)
+}
+
+// validateImages checks the references of the entry, its rollout and pins
+func (e CatalogEntry) validateImages() error {
+	if _, err := NormalizeImage(e.Image); err != nil {
+		return err
+	}
+	if e.Rollout != nil {
+		if e.Rollout.Percent < 0 || e.Rollout.Percent > 100 {
+			return fmt.Errorf("rollout percent must be between 0 and 100")
+		}
+		if _, err := NormalizeImage(e.Rollout.Image); err != nil {
+			return fmt.Errorf("rollout: %w", err)
+		}
+	}
+	for user, image := range e.Pinned {
+		if _, err := NormalizeImage(image); err != nil {
+			return fmt.Errorf("pinned image of %s: %w", user, err)
+		}
+	}
+	return nil
+}
+
+// validateTemplate checks that the template exists and its owner
+func (e CatalogEntry) validateTemplate() error {
+	if e.Template == "" {
+		return nil
+	}
+	if _, err := os.Stat(e.Template); err != nil {
+		return fmt.Errorf("failed to read template: %w", err)
+	}
+	_, _, err := parseOwner(e.TemplateOwner)
+	return err
+}
+
+// PoolConfig is the number of started, unassigned containers kept for an entry
+type PoolConfig struct {
+	Size     int          `json:"size"`
+	Schedule []PoolWindow `json:"schedule"`
+}
+
+// PoolWindow overrides the pool size between two times of day like "08:00" and "10:00"
+type PoolWindow struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Size int    `json:"size"`
+}
+
+// SizeAt returns the pool size for the given time. The first matching window wins.
+func (p *PoolConfig) SizeAt(t time.Time) int {
+	if p == nil {
+		return 0
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	for _, window := range p.Schedule {
+		from, _ := parseTimeOfDay(window.From)
+		to, _ := parseTimeOfDay(window.To)
+		if from <= to && minute >= from && minute < to {
+			return window.Size
+		}
+		// windows like 22:00 to 06:00 wrap around midnight
+		if from > to && (minute >= from || minute < to) {
+			return window.Size
+		}
+	}
+	return p.Size
+}
+
+func (p *PoolConfig) validate() error {
+	if p.Size < 0 {
+		return fmt.Errorf("invalid pool size: %d", p.Size)
+	}
+	for _, window := range p.Schedule {
+		if _, err := parseTimeOfDay(window.From); err != nil {
+			return err
+		}
+		if _, err := parseTimeOfDay(window.To); err != nil {
+			return err
+		}
+		if window.Size < 0 {
+			return fmt.Errorf("invalid pool size: %d", window.Size)
+		}
+	}
+	return nil
+}
+
+// parseTimeOfDay returns the minutes since midnight of a time like "08:30"
+func parseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day: %q", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// ParsePoolSchedule parses windows like "08:00-10:00=20"
+func ParsePoolSchedule(values []string) ([]PoolWindow, error) {
+	windows := make([]PoolWindow, 0, len(values))
+	for _, value := range values {
+		times, size, ok := strings.Cut(value, "=")
+		from, to, ok2 := strings.Cut(times, "-")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid pool schedule: %q", value)
+		}
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pool size in schedule: %q", value)
+		}
+		windows = append(windows, PoolWindow{From: from, To: to, Size: n})
+	}
+	return windows, nil
+}
+
+// AllowedFor reports whether a user with the given groups may use the entry.
+// Entries without groups are available to everyone.
+func (e CatalogEntry) AllowedFor(groups []string) bool {
+	if len(e.Groups) == 0 {
+		return true
+	}
+	for _, group := range groups {
+		if slices.Contains(e.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// ImageCatalog is the list of images users can choose from. The first entry is the default.
+type ImageCatalog struct {
+	Entries []CatalogEntry
+}
+
+// LoadImageCatalog reads the catalog file or builds a single default entry from the global config
+func LoadImageCatalog(config *Config) (*ImageCatalog, error) {
+	defaults := CatalogEntry{
+		Name:          "default",
+		Image:         config.DockerImage,
+		Cmd:           config.ContainerCMD,
+		User:          config.ContainerUser,
+		MountPath:     config.ContainerVFSMountPath,
+		Template:      config.WorkspaceTemplate,
+		TemplateOwner: config.WorkspaceTemplateOwner,
+		Pool: &PoolConfig{
+			Size:     config.PoolSize,
+			Schedule: config.poolSchedule,
+		},
+	}
+	if err := defaults.Pool.validate(); err != nil {
+		return nil, err
+	}
+	if config.RolloutImage != "" {
+		defaults.Rollout = &Rollout{Image: config.RolloutImage, Percent: config.RolloutPercent}
+	}
+	if err := defaults.validateImages(); err != nil {
+		return nil, err
+	}
+	if err := defaults.validateTemplate(); err != nil {
+		return nil, err
+	}
+
+	if config.ImageCatalog == "" {
+		return &ImageCatalog{Entries: []CatalogEntry{defaults}}, nil
+	}
+
+	data, err := os.ReadFile(config.ImageCatalog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image catalog: %w", err)
+	}
+
+	var entries []CatalogEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse image catalog: %w", err)
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("image catalog is empty")
+	}
+
+	seen := make(map[string]bool)
+	for i := range entries {
+		entry := &entries[i]
+		if !workspaceRegex.MatchString(entry.Name) {
+			return nil, fmt.Errorf("invalid image catalog entry name: %q", entry.Name)
+		}
+		if seen[entry.Name] {
+			return nil, fmt.Errorf("duplicate image catalog entry: %s", entry.Name)
+		}
+		seen[entry.Name] = true
+
+		if entry.Image == "" {
+			return nil, fmt.Errorf("image catalog entry %s has no image", entry.Name)
+		}
+		if err := entry.validateImages(); err != nil {
+			return nil, fmt.Errorf("image catalog entry %s: %w", entry.Name, err)
+		}
+		if entry.SecurityProfile != "" {
+			if _, err := LookupSecurityProfile(entry.SecurityProfile); err != nil {
+				return nil, fmt.Errorf("image catalog entry %s: %w", entry.Name, err)
+			}
+		}
+		if len(entry.Cmd) == 0 {
+			entry.Cmd = defaults.Cmd
+		}
+		if entry.User == "" {
+			entry.User = defaults.User
+		}
+		if entry.MountPath == "" {
+			entry.MountPath = defaults.MountPath
+		}
+		if entry.TemplateOwner == "" {
+			entry.TemplateOwner = defaults.TemplateOwner
+		}
+		if err := entry.validateTemplate(); err != nil {
+			return nil, fmt.Errorf("image catalog entry %s: %w", entry.Name, err)
+		}
+		if entry.Pool == nil {
+			entry.Pool = defaults.Pool
+		} else if err := entry.Pool.validate(); err != nil {
+			return nil, fmt.Errorf("image catalog entry %s: %w", entry.Name, err)
+		}
+	}
+
+	return &ImageCatalog{Entries: entries}, nil
+}
+
+// Allowed returns all entries available to a user with the given groups
+func (c *ImageCatalog) Allowed(groups []string) []CatalogEntry {
+	allowed := make([]CatalogEntry, 0, len(c.Entries))
+	for _, entry := range c.Entries {
+		if entry.AllowedFor(groups) {
+			allowed = append(allowed, entry)
+		}
+	}
+	return allowed
+}
+
+// Lookup returns the named entry if the user may use it. An empty name selects
+// the first entry available to the user.
+func (c *ImageCatalog) Lookup(name string, groups []string) (CatalogEntry, error) {
+	allowed := c.Allowed(groups)
+	if len(allowed) == 0 {
+		return CatalogEntry{}, fmt.Errorf("no image available for your groups")
+	}
+
+	if name == "" {
+		return allowed[0], nil
+	}
+
+	for _, entry := range allowed {
+		if entry.Name == name {
+			return entry, nil
+		}
+	}
+	return CatalogEntry{}, fmt.Errorf("image %q is not available", name)
+}
+
+// Get returns the named entry regardless of groups
+func (c *ImageCatalog) Get(name string) (CatalogEntry, bool) {
+	for _, entry := range c.Entries {
+		if entry.Name == name {
+			return entry, true
+		}
+	}
+	return CatalogEntry{}, false
+}
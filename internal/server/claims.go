@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/charmbracelet/ssh"
+)
+
+type contextKey string
+
+const claimsContextKey = contextKey("claims")
+
+// Claims holds the fields of the OAuth token response and the claims of its JWTs
+type Claims map[string]any
+
+// parseTokenResponse extracts claims from an OAuth token response. Claims of
+// the id and access token are merged in if they are JWTs. The token endpoint
+// is trusted, so signatures are not verified.
+func parseTokenResponse(body []byte) Claims {
+	claims := make(Claims)
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return claims
+	}
+
+	for _, tokenField := range []string{"id_token", "access_token"} {
+		token, ok := claims[tokenField].(string)
+		if !ok {
+			continue
+		}
+		parts := strings.Split(token, ".")
+		if len(parts) != 3 {
+			continue
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			continue
+		}
+		tokenClaims := make(Claims)
+		if err := json.Unmarshal(payload, &tokenClaims); err != nil {
+			continue
+		}
+		for k, v := range tokenClaims {
+			if _, exists := claims[k]; !exists {
+				claims[k] = v
+			}
+		}
+	}
+
+	// never keep the raw tokens around
+	delete(claims, "access_token")
+	delete(claims, "refresh_token")
+	delete(claims, "id_token")
+
+	return claims
+}
+
+// Groups returns the groups stored in the given claim. The claim may be a
+// list or a comma or space separated string.
+func (c Claims) Groups(claim string) []string {
+	groups := make([]string, 0)
+	switch value := c[claim].(type) {
+	case []any:
+		for _, v := range value {
+			if group, ok := v.(string); ok {
+				groups = append(groups, group)
+			}
+		}
+	case string:
+		groups = strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+	}
+	return groups
+}
+
+// sessionClaims returns the claims stored during authentication
+func sessionClaims(ctx ssh.Context) Claims {
+	if claims, ok := ctx.Value(claimsContextKey).(Claims); ok {
+		return claims
+	}
+	return Claims{}
+}
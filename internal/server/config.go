@@ -2,6 +2,8 @@ package server
 
 import (
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
 
 	"github.com/kelseyhightower/envconfig"
@@ -13,34 +15,106 @@ type Config struct {
 	SSHHostKey string `envconfig:"SSH_HOST_KEY" default:"/app/ssh_host_key"`
 	LogLevel   int    `envconfig:"LOG_LEVEL" default:"4"`
 	Quota      string `envconfig:"QUOTA" default:"1G"`
+	LoginMenu  bool   `envconfig:"LOGIN_MENU" default:"false"`
+	PolicyFile string `envconfig:"POLICY_FILE" default:""`
+	HooksFile  string `envconfig:"HOOKS_FILE" default:""`
+	InstanceID string `envconfig:"INSTANCE_ID" default:""` // separates servers sharing a runtime
 
 	// OAuth Configuration
-	OAuthEndpoint string `envconfig:"OAUTH_ENDPOINT" default:"http://proxy:3000"`
-	ClientID      string `envconfig:"CLIENT_ID" required:"true"`
-	ClientSecret  string `envconfig:"CLIENT_SECRET" required:"true"`
+	OAuthEndpoint    string `envconfig:"OAUTH_ENDPOINT" default:"http://proxy:3000"`
+	ClientID         string `envconfig:"CLIENT_ID" required:"true"`
+	ClientSecret     string `envconfig:"CLIENT_SECRET" required:"true"`
+	OAuthGroupsClaim string `envconfig:"OAUTH_GROUPS_CLAIM" default:"groups"`
+
+	// Runtime Configuration
+	Runtime      string `envconfig:"CONTAINER_RUNTIME" default:"docker"`
+	PodmanSocket string `envconfig:"PODMAN_SOCKET" default:"/run/podman/podman.sock"`
+
+	// Kubernetes Configuration
+	KubeConfig       string `envconfig:"KUBECONFIG"`
+	KubeNamespace    string `envconfig:"KUBE_NAMESPACE"`
+	KubeStorageClass string `envconfig:"KUBE_STORAGE_CLASS"`
 
 	// Docker Configuration
 	DockerImage           string   `envconfig:"DOCKER_IMAGE" default:"ubuntu:latest"`
-	MemoryLimit           string   `envconfig:"DOKCER_MEMORY_LIMIT" default:"512M"`
+	ImageCatalog          string   `envconfig:"IMAGE_CATALOG" default:""`
+	MemoryLimit           string   `envconfig:"DOCKER_MEMORY_LIMIT" default:"512M"`
 	CPULimit              float64  `envconfig:"DOCKER_CPU_LIMIT" default:"1.0"`
 	NetworkMode           string   `envconfig:"DOCKER_NETWORK_MODE" default:"bridge"`
 	Networks              []string `envconfig:"DOCKER_NETWORKS" default:""`
+	NetworkIsolation      string   `envconfig:"NETWORK_ISOLATION" default:"off"` // off, user or group
+	NetworkGateways       []string `envconfig:"NETWORK_GATEWAYS" default:""`     // containers joined to isolated networks, e.g. proxy:proxy
 	DockerDevices         []string `envconfig:"DOCKER_DEVICES" default:""`
 	DockerCapAdd          []string `envconfig:"DOCKER_CAP_ADD" default:""`
 	DockerSecurityOpt     []string `envconfig:"DOCKER_SEC_OPT" default:""`
 	DockerReadOnly        bool     `envconfig:"DOCKER_READ_ONLY" default:"false"`
 	DockerImagePullPolicy string   `envconfig:"DOCKER_IMAGE_PULL_POLICY" default:"unless-present"`
+	DockerMemorySwap      string   `envconfig:"DOCKER_MEMORY_SWAP" default:""`   // memory plus swap, -1 = unlimited
+	DockerPidsLimit       int64    `envconfig:"DOCKER_PIDS_LIMIT" default:"512"` // 0 = unlimited
+	DockerUlimits         []string `envconfig:"DOCKER_ULIMITS" default:""`       // e.g. nofile=1024:4096,nproc=512,core=0
+	DockerBlkioWeight     uint16   `envconfig:"DOCKER_BLKIO_WEIGHT" default:"0"` // 10-1000, 0 = unset
+	DockerDeviceReadBps   []string `envconfig:"DOCKER_DEVICE_READ_BPS" default:""`
+	DockerDeviceWriteBps  []string `envconfig:"DOCKER_DEVICE_WRITE_BPS" default:""`
+	DockerDeviceReadIops  []string `envconfig:"DOCKER_DEVICE_READ_IOPS" default:""`
+	DockerDeviceWriteIops []string `envconfig:"DOCKER_DEVICE_WRITE_IOPS" default:""`
+	DockerOomScoreAdj     int      `envconfig:"DOCKER_OOM_SCORE_ADJ" default:"0"`
 
-	ContainerCMD          []string `envconfig:"CONTAINER_CMD" default:"/bin/bash"`
+	RegistryAuthFile     string `envconfig:"REGISTRY_AUTH_FILE" default:""`       // Docker config.json with registry logins
+	ImageDigestAllowlist string `envconfig:"IMAGE_DIGEST_ALLOWLIST" default:""`   // file of allowed image digests
+	ImageUpdatePolicy    string `envconfig:"IMAGE_UPDATE_POLICY" default:"defer"` // off, defer or strict
+	RolloutImage         string `envconfig:"ROLLOUT_IMAGE" default:""`
+	RolloutPercent       int    `envconfig:"ROLLOUT_PERCENT" default:"0"`
+
+	ContainerCMD          []string `envconfig:"CONTAINER_CMD" default:""`
 	ContainerUser         string   `envconfig:"CONTAINER_USER" default:""`
 	ContainerIdleTimeout  int      `envconfig:"CONTAINER_IDLE_TIMEOUT" default:"60"` // 1 minute default
-	ContainerVFSMountPath string   `envconfig:"CONTAINER_VFS_MOUNT" default:"/workspace"`
+	ContainerPauseTimeout int      `envconfig:"CONTAINER_PAUSE_TIMEOUT" default:"0"` // 0 disables pausing
+	ContainerStopTimeout  int      `envconfig:"CONTAINER_STOP_TIMEOUT" default:"0"`  // 0 disables stopping
+	ContainerVFSMountPath string   `envconfig:"CONTAINER_VFS_MOUNT" default:""`
 	ContainerExtraMounts  []string `envconfig:"CONTAINER_MOUNTS" default:""`
+	MaxWorkspaces         int      `envconfig:"MAX_WORKSPACES" default:"3"`
+	RecoveryPolicy        string   `envconfig:"CONTAINER_RECOVERY_POLICY" default:"adopt"`
+
+	// Egress Proxy Configuration
+	EgressProxyListen       string `envconfig:"EGRESS_PROXY_LISTEN" default:""` // e.g. :3128, empty = disabled
+	EgressProxyURL          string `envconfig:"EGRESS_PROXY_URL" default:"http://proxy:3128"`
+	EgressProxySecret       string `envconfig:"EGRESS_PROXY_SECRET" default:""` // random per start if empty
+	EgressProxyAllowPrivate bool   `envconfig:"EGRESS_PROXY_ALLOW_PRIVATE" default:"false"`
+
+	// DNS Filter Configuration
+	DNSFilterListen    string   `envconfig:"DNS_FILTER_LISTEN" default:""`  // e.g. :53, empty = disabled
+	DNSFilterAddress   string   `envconfig:"DNS_FILTER_ADDRESS" default:""` // resolver IP of user containers, default the server IP
+	DNSFilterUpstreams []string `envconfig:"DNS_FILTER_UPSTREAMS" default:""`
+	DNSFilterSinkhole  string   `envconfig:"DNS_FILTER_SINKHOLE" default:""` // answer for blocked names, empty = NXDOMAIN
+
+	// User Namespace Configuration
+	UsernsMode    string `envconfig:"USERNS_MODE" default:""` // e.g. host, auto or keep-id, empty = runtime default
+	UsernsPerUser bool   `envconfig:"USERNS_PER_USER" default:"false"`
+	UsernsUIDBase int64  `envconfig:"USERNS_UID_BASE" default:"200000"`
+	UsernsUIDSize int64  `envconfig:"USERNS_UID_SIZE" default:"65536"`
+	UsernsMapFile string `envconfig:"USERNS_MAP_FILE" default:"/app/userns.json"`
+
+	// Workspace Template Configuration
+	WorkspaceTemplate      string `envconfig:"WORKSPACE_TEMPLATE" default:""` // directory or tarball seeded into new workspaces
+	WorkspaceTemplateOwner string `envconfig:"WORKSPACE_TEMPLATE_OWNER" default:"1000:1000"`
+	WorkspaceTemplateMerge bool   `envconfig:"WORKSPACE_TEMPLATE_MERGE" default:"false"`
+
+	// Security Profile Configuration
+	SecurityProfile       string `envconfig:"SECURITY_PROFILE" default:"strict"` // default, strict or debugging
+	SeccompProfileDir     string `envconfig:"SECCOMP_PROFILE_DIR" default:"/app/seccomp"`
+	SeccompProfileHostDir string `envconfig:"SECCOMP_PROFILE_HOST_DIR" default:""` // path of SECCOMP_PROFILE_DIR on the podman host
+
+	// Warm Pool Configuration
+	PoolSize         int      `envconfig:"POOL_SIZE" default:"0"`
+	PoolSchedule     []string `envconfig:"POOL_SCHEDULE" default:""`
+	PoolSlotHostPath string   `envconfig:"POOL_SLOT_HOST_PATH" default:""`
 
 	// Parsed values
 	memoryLimitBytes int64
 	cpuLimitNano     int64
 	quotaBytes       int64
+	resources        Resources // swap, pids, ulimits and block IO limits
+	poolSchedule     []PoolWindow
 }
 
 func LoadConfig() (*Config, error) {
@@ -49,13 +123,67 @@ func LoadConfig() (*Config, error) {
 		return nil, fmt.Errorf("failed to process config: %w", err)
 	}
 
+	if config.InstanceID != "" && !instanceRegex.MatchString(config.InstanceID) {
+		return nil, fmt.Errorf("invalid instance ID %q, use up to 16 lowercase letters and digits", config.InstanceID)
+	}
+	if config.InstanceID == defaultInstance {
+		return nil, fmt.Errorf("instance ID %q is reserved for servers without an ID", config.InstanceID)
+	}
+
+	if config.RecoveryPolicy != "adopt" && config.RecoveryPolicy != "remove" {
+		return nil, fmt.Errorf("invalid container recovery policy: %s", config.RecoveryPolicy)
+	}
+
+	switch config.ImageUpdatePolicy {
+	case "off", "defer", "strict":
+	default:
+		return nil, fmt.Errorf("invalid image update policy: %s", config.ImageUpdatePolicy)
+	}
+
+	switch config.NetworkIsolation {
+	case "off":
+	case "user", "group":
+		if config.Runtime == "kubernetes" {
+			return nil, fmt.Errorf("network isolation is not supported on Kubernetes, use NetworkPolicies")
+		}
+	default:
+		return nil, fmt.Errorf("invalid network isolation: %s", config.NetworkIsolation)
+	}
+
+	if config.Runtime == "docker" && config.UsernsMode != "" && config.UsernsMode != "host" {
+		return nil, fmt.Errorf("docker only supports the user namespace mode host, use userns-remap of the daemon instead")
+	}
+	if _, err := LookupSecurityProfile(config.SecurityProfile); err != nil {
+		return nil, err
+	}
+	if config.SeccompProfileHostDir == "" {
+		config.SeccompProfileHostDir = config.SeccompProfileDir
+	}
+
+	if config.UsernsPerUser && config.Runtime == "docker" {
+		return nil, fmt.Errorf("user namespaces per user are not supported by docker, use podman or kubernetes")
+	}
+
+	if err := validateIdleTimeouts(&config); err != nil {
+		return nil, err
+	}
+
+	poolSchedule, err := ParsePoolSchedule(config.PoolSchedule)
+	if err != nil {
+		return nil, err
+	}
+	config.poolSchedule = poolSchedule
+
 	size, err := ParseSize(config.Quota)
 	if err != nil {
 		return nil, fmt.Errorf("invalid quota: %w", err)
 	}
 	config.quotaBytes = int64(size)
 
-	// Parse memory limit
+	// Parse memory limit, DOKCER_MEMORY_LIMIT is the misspelled name of older releases
+	if legacy, ok := os.LookupEnv("DOKCER_MEMORY_LIMIT"); ok && os.Getenv("DOCKER_MEMORY_LIMIT") == "" {
+		config.MemoryLimit = legacy
+	}
 	memLimit, err := parseMemoryString(config.MemoryLimit)
 	if err != nil {
 		return nil, fmt.Errorf("invalid memory limit: %w", err)
@@ -65,6 +193,12 @@ func LoadConfig() (*Config, error) {
 	// Convert CPU limit to nano CPUs
 	config.cpuLimitNano = int64(config.CPULimit * 1000000000)
 
+	resources, err := parseResourceLimits(&config)
+	if err != nil {
+		return nil, err
+	}
+	config.resources = resources
+
 	return &config, nil
 }
 
@@ -90,3 +224,98 @@ func parseMemoryString(val string) (int64, error) {
 
 	return result * multiplier, nil
 }
+
+// validateIdleTimeouts checks that the idle tiers pause, stop and remove follow each other
+func validateIdleTimeouts(config *Config) error {
+	if config.ContainerPauseTimeout < 0 || config.ContainerStopTimeout < 0 {
+		return fmt.Errorf("idle timeouts must not be negative")
+	}
+	if config.Runtime == "kubernetes" && (config.ContainerPauseTimeout > 0 || config.ContainerStopTimeout > 0) {
+		return fmt.Errorf("pausing and stopping containers is not supported on Kubernetes")
+	}
+	if config.ContainerPauseTimeout > 0 && config.ContainerStopTimeout > 0 && config.ContainerPauseTimeout >= config.ContainerStopTimeout {
+		return fmt.Errorf("CONTAINER_PAUSE_TIMEOUT must be shorter than CONTAINER_STOP_TIMEOUT")
+	}
+	for _, timeout := range []int{config.ContainerPauseTimeout, config.ContainerStopTimeout} {
+		if timeout > 0 && timeout >= config.ContainerIdleTimeout {
+			return fmt.Errorf("pause and stop timeouts must be shorter than CONTAINER_IDLE_TIMEOUT")
+		}
+	}
+	return nil
+}
+
+// parseResourceLimits validates the process, file descriptor and IO limits
+func parseResourceLimits(config *Config) (Resources, error) {
+	res := Resources{
+		MemoryBytes: config.memoryLimitBytes,
+		NanoCPUs:    config.cpuLimitNano,
+		PidsLimit:   config.DockerPidsLimit,
+		BlkioWeight: config.DockerBlkioWeight,
+		OomScoreAdj: config.DockerOomScoreAdj,
+	}
+
+	if config.DockerMemorySwap != "" {
+		swap, err := parseMemorySwap(config.DockerMemorySwap)
+		if err != nil {
+			return res, err
+		}
+		if swap > 0 && swap < res.MemoryBytes {
+			return res, fmt.Errorf("DOCKER_MEMORY_SWAP must not be lower than DOCKER_MEMORY_LIMIT")
+		}
+		res.MemorySwapBytes = swap
+	}
+
+	if res.PidsLimit < 0 {
+		return res, fmt.Errorf("invalid pids limit: %d", res.PidsLimit)
+	}
+
+	if res.BlkioWeight != 0 && (res.BlkioWeight < 10 || res.BlkioWeight > 1000) {
+		return res, fmt.Errorf("blkio weight must be between 10 and 1000")
+	}
+
+	if res.OomScoreAdj < -1000 || res.OomScoreAdj > 1000 {
+		return res, fmt.Errorf("OOM score adjustment must be between -1000 and 1000")
+	}
+
+	var err error
+	if res.Ulimits, err = ParseUlimits(config.DockerUlimits); err != nil {
+		return res, err
+	}
+	if res.DeviceReadBps, err = parseThrottleDevices(config.DockerDeviceReadBps, true); err != nil {
+		return res, err
+	}
+	if res.DeviceWriteBps, err = parseThrottleDevices(config.DockerDeviceWriteBps, true); err != nil {
+		return res, err
+	}
+	if res.DeviceReadIops, err = parseThrottleDevices(config.DockerDeviceReadIops, false); err != nil {
+		return res, err
+	}
+	if res.DeviceWriteIops, err = parseThrottleDevices(config.DockerDeviceWriteIops, false); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// parseThrottleDevices parses limits like "/dev/sda:10M" for bytes or "/dev/sda:1000" for IO operations per second
+func parseThrottleDevices(values []string, bytes bool) ([]ThrottleDevice, error) {
+	devices := make([]ThrottleDevice, 0, len(values))
+	for _, value := range values {
+		path, rate, ok := strings.Cut(value, ":")
+		if !ok || !strings.HasPrefix(path, "/dev/") {
+			return nil, fmt.Errorf("invalid device limit: %q", value)
+		}
+
+		var n uint64
+		var err error
+		if bytes {
+			n, err = ParseSize(rate)
+		} else {
+			n, err = strconv.ParseUint(rate, 10, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate in device limit %q", value)
+		}
+		devices = append(devices, ThrottleDevice{Path: path, Rate: n})
+	}
+	return devices, nil
+}
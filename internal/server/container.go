@@ -2,58 +2,99 @@ package server
 
 import (
     "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
     "fmt"
-    "github.com/docker/docker/api/types/filters"
-    "github.com/docker/docker/api/types/image"
     "os"
     "os/exec"
     "path"
+    "slices"
+    "strconv"
     "strings"
     "sync"
+    "sync/atomic"
     "time"
 
-    "github.com/docker/docker/api/types"
-    "github.com/docker/docker/api/types/container"
-    "github.com/docker/docker/api/types/mount"
-    "github.com/docker/docker/api/types/network"
-    "github.com/docker/docker/api/types/volume"
-    "github.com/docker/docker/client"
+    "github.com/distribution/reference"
+    "github.com/opencontainers/go-digest"
     "github.com/sirupsen/logrus"
 )
 
+const (
+    // imagePullTimeout bounds image pulls, a hung registry fails the login
+    imagePullTimeout = 10 * time.Minute
+    // containerStartTimeout bounds starting and unpausing containers at login
+    containerStartTimeout = 5 * time.Minute
+)
+
 // UserContainer represents a container for a specific user
 type UserContainer struct {
     ID            string
     User          string
-    ActiveStreams int
+    Workspace     string
+    Image         CatalogEntry
+    State         string
+    PoolSlot      string // set if the container was claimed from the warm pool
+    Env           []string // owner of a claimed pooled container, passed to every exec
+    Addresses     []string // IP addresses of the container
+    Network       string // set if the container runs in an isolated network
+    Limits        Limits
     LastUsed      time.Time
+    leases        map[string]time.Time // map of lease ID to last renewal
+    oomKilled     bool
+    generation    uint64 // generation of the manager when tracked or when the state last changed
     mutex         sync.Mutex
 }
 
 type ContainerConfig struct {
-    Image   string
-    Cmd     []string
-    Env     []string
-    IsPty   bool
-    PtyRows uint16
-    PtyCols uint16
-    User    string
+    Image     string
+    Entry     CatalogEntry
+    Workspace Workspace
+    Cmd       []string
+    Env       []string
+    IsPty     bool
+    PtyRows   uint16
+    PtyCols   uint16
+    User      string
+    Limits    Limits
+    Network   string // isolated network of the container, empty without network isolation
 }
 
+// ErrUsageUnavailable is returned by QuotaUsage if the runtime does not report the used storage
+var ErrUsageUnavailable = errors.New("storage usage unavailable")
+
 type ContainerManager struct {
-    client          *client.Client
+    runtime         Runtime
     config          *Config
+    catalog         *ImageCatalog
+    policy          *Policy
     log             *logrus.Logger
-    containers      map[string]*UserContainer // map of username to container
+    containers      map[string]*UserContainer // map of workspace key to container
+    pending         map[string]string         // map of workspace key to network of containers being created or removed
     containersMutex sync.RWMutex
+    generation      atomic.Uint64 // counts tracked containers and state changes, see reconcile
+    userLocks       *keyedMutex // serializes GetOrCreateContainer per user
     shutdownChan    chan struct{}
+    serverID        string
     blockDevice     string
+    storage         ManagedStorage // nil if workspaces live on the local btrfs VFS
+    pool            *ContainerPool // nil if the warm pool is disabled
+    notices         *noticeBoard
+    runtimeInfo     RuntimeInfo
+    uidMap          *UIDMap // nil if users share the ID range of the runtime
+    appArmor        bool    // whether the AppArmor profiles of security profiles apply
+    registry        *RegistryCredentials
+    allowlist       DigestAllowlist // nil if every image may run
+    imageChecks     *imageChecks
+    hooks           []Hook
 }
 
-func NewContainerManager(config *Config, log *logrus.Logger) (*ContainerManager, error) {
-    dockerClient, err := client.NewClientWithOpts(client.FromEnv)
+func NewContainerManager(config *Config, catalog *ImageCatalog, policy *Policy, log *logrus.Logger) (*ContainerManager, error) {
+    runtime, err := NewRuntime(config)
     if err != nil {
-        return nil, fmt.Errorf("failed to create Docker client: %w", err)
+        return nil, err
     }
 
     containerId := os.Getenv("CONTAINER_ID")
@@ -61,38 +102,146 @@ func NewContainerManager(config *Config, log *logrus.Logger) (*ContainerManager,
         return nil, fmt.Errorf("failed to get current container ID")
     }
 
+    storage, _ := runtime.(ManagedStorage)
+
     blockDevice := os.Getenv("BLOCK_DEVICE")
-    if blockDevice == "" {
+    if blockDevice == "" && storage == nil {
         return nil, fmt.Errorf("failed to get current mounted blockdevice")
     }
 
+    registry, err := LoadRegistryCredentials(config.RegistryAuthFile)
+    if err != nil {
+        return nil, err
+    }
+
+    allowlist, err := LoadDigestAllowlist(config.ImageDigestAllowlist)
+    if err != nil {
+        return nil, err
+    }
+
+    hooks, err := LoadHooks(config.HooksFile)
+    if err != nil {
+        return nil, err
+    }
+
     ctx := context.Background()
-    ct, err := dockerClient.ContainerInspect(ctx, containerId)
+    runtimeInfo, err := runtime.Info(ctx)
+    if err != nil {
+        return nil, err
+    }
+    if runtimeInfo.Rootless {
+        log.WithField("uid", runtimeInfo.UID).Infof("Using rootless %s", runtime.Name())
+    }
+
+    var uidMap *UIDMap
+    if config.UsernsPerUser {
+        if runtimeInfo.Rootless {
+            return nil, fmt.Errorf("user namespaces per user need a rootful %s", runtime.Name())
+        }
+        if storage == nil {
+            uidMap, err = LoadUIDMap(config.UsernsMapFile, config.UsernsUIDBase, config.UsernsUIDSize)
+            if err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    // Kubernetes nodes load the AppArmor profiles themselves
+    var appArmor bool
+    if runtime.Name() != "kubernetes" {
+        appArmor, err = loadAppArmorProfiles(log)
+        if err != nil {
+            return nil, err
+        }
+    }
+    // podman reads seccomp profiles from files on its host
+    if runtime.Name() == "podman" {
+        if err := writeSeccompProfiles(config.SeccompProfileDir); err != nil {
+            return nil, err
+        }
+    }
+
+    ct, err := runtime.InspectContainer(ctx, containerId)
     if err != nil {
         return nil, fmt.Errorf("failed to inspect container: %v", err)
     }
 
-    if len(ct.NetworkSettings.Networks) == 0 && len(config.Networks) == 0 {
+    if len(ct.Network) == 0 && len(config.Networks) == 0 {
         return nil, fmt.Errorf("no network settings found")
     }
 
-    for networkName := range ct.NetworkSettings.Networks {
-        if len(ct.NetworkSettings.Networks) == 1 || strings.HasSuffix(networkName, "_default") {
+    for networkName := range ct.Network {
+        if len(ct.Network) == 1 || strings.HasSuffix(networkName, "_default") {
             config.Networks = append(config.Networks, networkName)
         }
     }
 
     cm := &ContainerManager{
-        client:       dockerClient,
+        runtime:      runtime,
         config:       config,
+        catalog:      catalog,
+        policy:       policy,
         log:          log,
         containers:   make(map[string]*UserContainer),
+        pending:      make(map[string]string),
+        userLocks:    newKeyedMutex(),
         shutdownChan: make(chan struct{}),
+        serverID:     containerId,
         blockDevice:  blockDevice,
+        storage:      storage,
+        notices:      newNoticeBoard(),
+        registry:     registry,
+        allowlist:    allowlist,
+        imageChecks:  newImageChecks(),
+        runtimeInfo:  runtimeInfo,
+        uidMap:       uidMap,
+        appArmor:     appArmor,
+        hooks:        hooks,
+    }
+
+    if storage != nil {
+        for _, entry := range catalog.Entries {
+            if entry.Template != "" {
+                return nil, fmt.Errorf("workspace templates are not supported with runtime %s", runtime.Name())
+            }
+        }
+    }
+
+    if config.InstanceID != "" {
+        log.WithField("instance", config.InstanceID).Info("Scoping containers, volumes and networks to instance")
+    }
+    // instances sharing the VFS keep their workspaces in separate directories
+    if storage == nil {
+        if err := os.MkdirAll(cm.vfsDir(), 0755); err != nil {
+            return nil, fmt.Errorf("failed to create instance VFS directory: %w", err)
+        }
+    }
+
+    if config.PoolSlotHostPath != "" {
+        if storage != nil {
+            return nil, fmt.Errorf("the warm pool is not supported with runtime %s", runtime.Name())
+        }
+        if config.NetworkIsolation != "off" {
+            return nil, fmt.Errorf("the warm pool is not supported with network isolation")
+        }
+        if config.UsernsPerUser {
+            return nil, fmt.Errorf("the warm pool is not supported with user namespaces per user")
+        }
+        cm.pool = newContainerPool(cm, config.PoolSlotHostPath)
+    }
+
+    // Adopt or remove containers left over from a previous run
+    if err := cm.reconcile(ctx); err != nil {
+        return nil, fmt.Errorf("failed to recover containers: %w", err)
     }
 
     // Start container cleanup goroutine
     go cm.cleanupLoop()
+    go cm.watchEvents()
+
+    if cm.pool != nil {
+        go cm.pool.run(cm.shutdownChan)
+    }
 
     return cm, nil
 }
@@ -104,6 +253,9 @@ func (cm *ContainerManager) cleanupLoop() {
     for {
         select {
         case <-ticker.C:
+            if err := cm.reconcile(context.Background()); err != nil {
+                cm.log.WithError(err).Error("Failed to reconcile containers")
+            }
             cm.cleanupIdleContainers()
         case <-cm.shutdownChan:
             return
@@ -111,72 +263,486 @@ func (cm *ContainerManager) cleanupLoop() {
     }
 }
 
+// cleanupIdleContainers moves idle containers through the tiers pause, stop and
+// remove. Paused and stopped containers are resumed by GetOrCreateContainer.
 func (cm *ContainerManager) cleanupIdleContainers() {
-    cm.containersMutex.Lock()
-    defer cm.containersMutex.Unlock()
+    cm.containersMutex.RLock()
+    idle := make([]*UserContainer, 0)
+    for _, ct := range cm.containers {
+        ct.mutex.Lock()
+        if cm.activeLeases(ct) == 0 {
+            idle = append(idle, ct)
+        }
+        ct.mutex.Unlock()
+    }
+    cm.containersMutex.RUnlock()
 
-    ctx := context.Background()
-    timeout := time.Duration(cm.config.ContainerIdleTimeout) * time.Second
-
-    for username, uc := range cm.containers {
-        uc.mutex.Lock()
-        if uc.ActiveStreams == 0 && time.Since(uc.LastUsed) > timeout {
-            cm.log.WithFields(logrus.Fields{
-                "user":        username,
-                "containerID": uc.ID,
-                "idleTime":    time.Since(uc.LastUsed),
-            }).Info("Removing idle container")
-
-            if err := cm.removeContainer(ctx, username); err != nil {
-                cm.log.WithError(err).Error("Failed to remove idle container")
-            }
+    for _, ct := range idle {
+        cm.cleanupIdleContainer(context.Background(), ct)
+    }
+}
+
+// cleanupIdleContainer pauses, stops or removes the container if it is idle
+// long enough. The runtime calls hold the lock of the user instead of the
+// container map, so only logins of the user wait for them. A login during the
+// removal gets a new container.
+func (cm *ContainerManager) cleanupIdleContainer(ctx context.Context, ct *UserContainer) {
+    unlock := cm.userLocks.Lock(ct.User)
+    defer unlock()
+
+    ws := Workspace{User: ct.User, Name: ct.Workspace}
+    cm.containersMutex.RLock()
+    current := cm.containers[ws.Key()]
+    cm.containersMutex.RUnlock()
+    // removed or replaced since it was found idle
+    if current != ct {
+        return
+    }
+
+    removeTimeout := time.Duration(cm.config.ContainerIdleTimeout) * time.Second
+    stopTimeout := time.Duration(cm.config.ContainerStopTimeout) * time.Second
+    pauseTimeout := time.Duration(cm.config.ContainerPauseTimeout) * time.Second
+
+    ct.mutex.Lock()
+    if cm.activeLeases(ct) > 0 {
+        ct.mutex.Unlock()
+        return
+    }
+    idleTime := time.Since(ct.LastUsed)
+    state := ct.State
+    ct.mutex.Unlock()
+
+    fields := logrus.Fields{
+        "user":        ct.User,
+        "workspace":   ct.Workspace,
+        "containerID": ct.ID,
+        "idleTime":    idleTime,
+    }
+
+    switch {
+    case idleTime > removeTimeout:
+        cm.log.WithFields(fields).Info("Removing idle container")
+        if err := cm.removeContainer(ctx, ws.Key()); err != nil {
+            cm.log.WithError(err).Error("Failed to remove idle container")
+        } else {
+            go cm.RunHooks(ctx, HookContainerIdleRemoved, ws, ct.ID, ct.Image)
+        }
+    case stopTimeout > 0 && idleTime > stopTimeout && state != "exited":
+        cm.log.WithFields(fields).Info("Stopping idle container")
+        if err := cm.changeState(ctx, ct, "exited", cm.runtime.StopContainer); err != nil {
+            cm.log.WithError(err).Error("Failed to stop idle container")
+        }
+    case pauseTimeout > 0 && idleTime > pauseTimeout && state == "running":
+        cm.log.WithFields(fields).Info("Pausing idle container")
+        if err := cm.changeState(ctx, ct, "paused", cm.runtime.PauseContainer); err != nil {
+            cm.log.WithError(err).Error("Failed to pause idle container")
         }
-        uc.mutex.Unlock()
     }
 }
 
-func (cm *ContainerManager) GetOrCreateContainer(ctx context.Context, username string, env []string) (string, error) {
-    cm.containersMutex.Lock()
-    defer cm.containersMutex.Unlock()
+// changeState sets the state before calling the runtime, so the events of the
+// call are known to be expected, and restores it if the call fails
+func (cm *ContainerManager) changeState(ctx context.Context, ct *UserContainer, state string, change func(context.Context, string) error) error {
+    ct.mutex.Lock()
+    previous := ct.State
+    cm.setState(ct, state)
+    ct.mutex.Unlock()
 
-    // Check if ct exists for user
-    if ct, exists := cm.containers[username]; exists {
+    if err := change(ctx, ct.ID); err != nil {
         ct.mutex.Lock()
-        ct.ActiveStreams++
-        ct.LastUsed = time.Now()
+        cm.setState(ct, previous)
         ct.mutex.Unlock()
-        return ct.ID, nil
+        return err
     }
+    return nil
+}
+
+// setState changes the state of the container. The caller must hold ct.mutex.
+func (cm *ContainerManager) setState(ct *UserContainer, state string) {
+    ct.State = state
+    ct.generation = cm.generation.Add(1)
+}
 
-    // Create new ct for user
+// track adds the container to the map. The caller must hold containersMutex.
+func (cm *ContainerManager) track(key string, ct *UserContainer) {
+    ct.mutex.Lock()
+    ct.generation = cm.generation.Add(1)
+    ct.mutex.Unlock()
+    cm.containers[key] = ct
+}
+
+// GetOrCreateContainer returns a lease on the container of the workspace and
+// the catalog entry it runs, with defaults from the image applied. New
+// containers get the given limits, a running container keeps its limits. The
+// lease has to be released with ReleaseContainer.
+//
+// Logins of different users run in parallel. Logins of the same user wait for
+// each other and for the idle cleanup of the user's containers, so concurrent
+// sessions share the container the first one creates and the workspace limit
+// holds.
+func (cm *ContainerManager) GetOrCreateContainer(ctx context.Context, ws Workspace, entry CatalogEntry, limits Limits, env []string) (*Lease, CatalogEntry, error) {
+    leaseID, err := newLeaseID()
+    if err != nil {
+        return nil, entry, err
+    }
+
+    unlock := cm.userLocks.Lock(ws.User)
+    defer unlock()
+
+    // pooled containers run the image of the entry, not a pinned or rollout image
+    image := entry.ImageFor(ws.User)
+    poolable := image == entry.Image
+    entry.Image = image
+
+    // Check if ct exists for workspace
+    cm.containersMutex.RLock()
+    ct, exists := cm.containers[ws.Key()]
+    cm.containersMutex.RUnlock()
+    if exists {
+        fields := logrus.Fields{
+            "user":      ws.User,
+            "workspace": ws.Name,
+        }
+        ct.mutex.Lock()
+        running := ct.Image
+        ct.mutex.Unlock()
+
+        // the pull and the start run without ct.mutex, the event handler, the
+        // proxy and the DNS filter need it meanwhile. The user lock keeps the
+        // idle cleanup away from the container.
+        sameImage := running.Name == entry.Name
+        outdated := sameImage && cm.imageOutdated(running.ImageID, entry)
+        ct.mutex.Lock()
+        inUse := cm.activeLeases(ct) > 0
+        ct.mutex.Unlock()
+        if sameImage && (!outdated || inUse && cm.config.ImageUpdatePolicy == "defer") {
+            if outdated {
+                cm.log.WithFields(fields).Info("Deferring image update while the workspace is in use")
+            }
+            if err := cm.ensureRunning(ctx, ct); err != nil {
+                return nil, entry, err
+            }
+            ct.mutex.Lock()
+            lease := ct.acquireLease(leaseID)
+            ct.mutex.Unlock()
+            return lease, running, nil
+        }
+
+        // the workspace runs a different or outdated image, replace the container if nobody uses it
+        current := running.Name
+        if inUse && outdated {
+            return nil, entry, fmt.Errorf("workspace %s is updated to a new image, close its other sessions first", ws.Name)
+        } else if inUse {
+            return nil, entry, fmt.Errorf("workspace %s is in use with image %s", ws.Name, current)
+        }
+
+        if outdated {
+            cm.log.WithFields(fields).WithField("image", entry.Image).Info("Replacing container with outdated image")
+        } else {
+            fields["oldImage"] = current
+            fields["newImage"] = entry.Name
+            cm.log.WithFields(fields).Info("Replacing container with different image")
+        }
+        if err := cm.removeContainer(ctx, ws.Key()); err != nil {
+            return nil, entry, err
+        }
+    }
+
+    if err := cm.checkWorkspaceLimit(ws); err != nil {
+        return nil, entry, err
+    }
+
+    workspaceExists, err := cm.workspaceExists(ctx, ws)
+    if err != nil {
+        return nil, entry, err
+    }
+
+    // reconcile leaves the container alone until it is tracked
+    cm.setPending(ws, "")
+    defer cm.clearPending(ws)
+
+    // pooled containers run with the default profile
+    if cm.pool != nil && poolable && limits.Profile == cm.policy.Default().Profile {
+        if pooled, ok := cm.pool.Claim(ctx, ws, entry, limits); ok {
+            ct := &UserContainer{
+                ID:        pooled.ID,
+                User:      ws.User,
+                Workspace: ws.Name,
+                Image:     pooled.Entry,
+                State:     "running",
+                PoolSlot:  pooled.Slot,
+                Env:       ownerEnv(ctx, ws),
+                Limits:    limits,
+                LastUsed:  time.Now(),
+            }
+            cm.updateAddresses(ctx, ct)
+            cm.containersMutex.Lock()
+            cm.track(ws.Key(), ct)
+            cm.pool.claimed(pooled.Slot)
+            cm.containersMutex.Unlock()
+            if err := cm.createdHooks(ctx, ws, ct, !workspaceExists); err != nil {
+                return nil, entry, err
+            }
+            ct.mutex.Lock()
+            lease := ct.acquireLease(leaseID)
+            ct.mutex.Unlock()
+            return lease, pooled.Entry, nil
+        }
+    }
+
+    entry, err = cm.prepareImage(ctx, entry)
+    if err != nil {
+        return nil, entry, err
+    }
+
+    // Create new ct for workspace
     containerConfig := ContainerConfig{
-        Image: cm.config.DockerImage,
-        User:  username,
-        Env:   env,
+        Image:     entry.Image,
+        Entry:     entry,
+        Workspace: ws,
+        User:      ws.User,
+        Env:       env,
+        Limits:    limits,
+    }
+
+    network, err := cm.isolatedNetwork(containerConfig)
+    if err != nil {
+        return nil, entry, err
+    }
+    if network != "" {
+        // keeps other users from removing the network while it is unused
+        cm.setPending(ws, network)
+        if err := cm.ensureNetwork(ctx, network); err != nil {
+            return nil, entry, err
+        }
+        containerConfig.Network = network
+    }
+
+    releaseNetwork := func() {
+        if network == "" {
+            return
+        }
+        cm.containersMutex.Lock()
+        delete(cm.pending, ws.Key())
+        cm.releaseNetwork(ctx, network)
+        cm.containersMutex.Unlock()
     }
 
     containerID, err := cm.createContainer(ctx, containerConfig)
     if err != nil {
-        return "", err
+        releaseNetwork()
+        return nil, entry, err
     }
 
-    if err := cm.client.ContainerStart(ctx, containerID, container.StartOptions{}); err != nil {
-        return "", fmt.Errorf("failed to start ct: %w", err)
+    startCtx, cancel := context.WithTimeout(ctx, containerStartTimeout)
+    defer cancel()
+    if err := cm.runtime.StartContainer(startCtx, containerID); err != nil {
+        // the container never ran, the next login creates a new one
+        if removeErr := cm.runtime.RemoveContainer(ctx, containerID); removeErr != nil {
+            cm.log.WithError(removeErr).WithField("containerID", containerID).Error("Failed to remove container after failed start")
+        } else if removeErr := cm.RemoveVFSMount(ctx, containerConfig); removeErr != nil {
+            cm.log.WithError(removeErr).WithField("containerID", containerID).Error("Failed to remove vfs mount after failed start")
+        }
+        releaseNetwork()
+        return nil, entry, fmt.Errorf("failed to start ct: %w", err)
     }
 
-    cm.containers[username] = &UserContainer{
-        ID:            containerID,
-        User:          username,
-        ActiveStreams: 1,
-        LastUsed:      time.Now(),
+    ct = &UserContainer{
+        ID:        containerID,
+        User:      ws.User,
+        Workspace: ws.Name,
+        Image:     entry,
+        State:     "running",
+        Network:   network,
+        Limits:    limits,
+        LastUsed:  time.Now(),
+    }
+    cm.updateAddresses(ctx, ct)
+    cm.containersMutex.Lock()
+    cm.track(ws.Key(), ct)
+    cm.containersMutex.Unlock()
+    // leased only after the hooks, a container that failed them and could not
+    // be removed is left to the idle cleanup
+    if err := cm.createdHooks(ctx, ws, ct, !workspaceExists); err != nil {
+        return nil, entry, err
     }
 
-    return containerID, nil
+    ct.mutex.Lock()
+    lease := ct.acquireLease(leaseID)
+    ct.mutex.Unlock()
+    return lease, entry, nil
+}
+
+// setPending marks the workspace as having a container being created in the
+// network or removed
+func (cm *ContainerManager) setPending(ws Workspace, network string) {
+    cm.containersMutex.Lock()
+    defer cm.containersMutex.Unlock()
+    cm.pending[ws.Key()] = network
+}
+
+func (cm *ContainerManager) clearPending(ws Workspace) {
+    cm.containersMutex.Lock()
+    defer cm.containersMutex.Unlock()
+    delete(cm.pending, ws.Key())
+}
+
+// prepareImage pulls the image of the entry and fills the exec command, user
+// and workdir the entry leaves open from the image labels and image config.
+func (cm *ContainerManager) prepareImage(ctx context.Context, entry CatalogEntry) (CatalogEntry, error) {
+    if err := cm.pullImage(ctx, entry.Image); err != nil {
+        return entry, fmt.Errorf("failed to pull image: %w", err)
+    }
+    if err := cm.verifyDigest(ctx, entry.Image); err != nil {
+        return entry, err
+    }
+    entry, err := cm.imageDefaults(ctx, entry)
+    if err != nil {
+        return entry, err
+    }
+    cm.imageChecks.record(entry.Image, entry.ImageID)
+    return entry, nil
+}
+
+// imageOutdated reports whether a newer image than the one with the ID is
+// available for the entry. Logins do not wait for the registry, the ID is
+// compared with the last check and the check is refreshed in the background
+// once it is older than imageCheckInterval. Containers without a known image
+// ID are kept.
+func (cm *ContainerManager) imageOutdated(imageID string, entry CatalogEntry) bool {
+    if cm.config.ImageUpdatePolicy == "off" || imageID == "" {
+        return false
+    }
+
+    latest, refresh := cm.imageChecks.latest(entry.Image)
+    if refresh {
+        go cm.refreshImage(entry)
+    }
+    return latest != "" && latest != imageID
+}
+
+// refreshImage pulls the image of the entry and records the ID it resolves to
+func (cm *ContainerManager) refreshImage(entry CatalogEntry) {
+    defer cm.imageChecks.refreshed(entry.Image)
+    if _, err := cm.prepareImage(context.Background(), entry); err != nil {
+        cm.log.WithError(err).WithField("image", entry.Image).Warn("Failed to check for image update")
+    }
+}
+
+// verifyDigest refuses images whose digest is not on the allowlist. Images
+// pinned with @sha256: are checked by the pinned digest, others by the digests
+// the registry reported on pull.
+func (cm *ContainerManager) verifyDigest(ctx context.Context, dockerImage string) error {
+    if cm.allowlist == nil {
+        return nil
+    }
+
+    named, err := NormalizeImage(dockerImage)
+    if err != nil {
+        return err
+    }
+
+    var digests []digest.Digest
+    if canonical, ok := named.(reference.Canonical); ok {
+        digests = append(digests, canonical.Digest())
+    } else {
+        img, err := cm.runtime.InspectImage(ctx, dockerImage)
+        if err != nil {
+            return fmt.Errorf("failed to inspect image: %w", err)
+        }
+        for _, repoDigest := range img.RepoDigests {
+            ref, err := reference.ParseNormalizedNamed(repoDigest)
+            if err != nil {
+                continue
+            }
+            if canonical, ok := ref.(reference.Canonical); ok {
+                digests = append(digests, canonical.Digest())
+            }
+        }
+    }
+
+    if !cm.allowlist.Allows(digests...) {
+        cm.log.WithFields(logrus.Fields{
+            "dockerImage": dockerImage,
+            "digests":     digests,
+        }).Warn("Refused image with a digest not on the allowlist")
+        return fmt.Errorf("image %s is not on the digest allowlist", dockerImage)
+    }
+    return nil
+}
+
+// imageDefaults fills the settings of the entry that are left open from the local image
+func (cm *ContainerManager) imageDefaults(ctx context.Context, entry CatalogEntry) (CatalogEntry, error) {
+    img, err := cm.runtime.InspectImage(ctx, entry.Image)
+    if err != nil {
+        return entry, fmt.Errorf("failed to inspect image: %w", err)
+    }
+    labels := img.Labels
+
+    // runtimes that cannot inspect images identify them by a hash of the
+    // reference, references are no valid Kubernetes label values
+    entry.ImageID = img.ID
+    if entry.ImageID == "" {
+        sum := sha256.Sum256([]byte(entry.Image))
+        entry.ImageID = "ref-" + hex.EncodeToString(sum[:16])
+    }
+
+    if len(entry.Cmd) == 0 {
+        if label := labels["de.mc8051.sshcontainer.cmd"]; label != "" {
+            entry.Cmd = parseCmdLabel(label)
+        }
+    }
+    if len(entry.Cmd) == 0 {
+        entry.Cmd = []string{"/bin/bash"}
+    }
+
+    if entry.User == "" {
+        entry.User = labels["de.mc8051.sshcontainer.user"]
+    }
+    if entry.User == "" {
+        entry.User = img.User
+    }
+
+    // the WORKDIR of the image is not used, mounting the workspace over it
+    // would hide the files of the image
+    if entry.MountPath == "" {
+        entry.MountPath = labels["de.mc8051.sshcontainer.workdir"]
+    }
+    if entry.MountPath == "" {
+        entry.MountPath = "/workspace"
+    }
+
+    cm.log.WithFields(logrus.Fields{
+        "image":     entry.Image,
+        "cmd":       entry.Cmd,
+        "user":      entry.User,
+        "mountPath": entry.MountPath,
+    }).Debug("Resolved image settings")
+
+    return entry, nil
+}
+
+// parseCmdLabel parses a command label given as JSON array or as space separated words
+func parseCmdLabel(label string) []string {
+    var cmd []string
+    if strings.HasPrefix(strings.TrimSpace(label), "[") {
+        if err := json.Unmarshal([]byte(label), &cmd); err == nil {
+            return cmd
+        }
+    }
+    return strings.Fields(label)
 }
 
 func (cm *ContainerManager) pullImage(ctx context.Context, dockerImage string) error {
+    ctx, cancel := context.WithTimeout(ctx, imagePullTimeout)
+    defer cancel()
+
+    named, err := NormalizeImage(dockerImage)
+    if err != nil {
+        return err
+    }
     pullFields := logrus.Fields{
-        "dockerImage": dockerImage,
+        "dockerImage": named.String(),
     }
     if cm.config.DockerImagePullPolicy == "never" {
         cm.log.WithFields(pullFields).Debug("Skipping image pull")
@@ -186,240 +752,256 @@ func (cm *ContainerManager) pullImage(ctx context.Context, dockerImage string) e
     } else {
         cm.log.WithFields(pullFields).Debug("Pulling image if not present")
         // pull image only if not present
-        images, err := cm.client.ImageList(ctx, image.ListOptions{})
+        present, err := cm.runtime.ImageExists(ctx, named.String())
         if err != nil {
-            return fmt.Errorf("failed to list images: %w", err)
+            return err
         }
-
-        for _, img := range images {
-            for _, tag := range img.RepoTags {
-                if tag == dockerImage {
-                    cm.log.WithFields(pullFields).Debug("Image already present")
-                    return nil
-                }
-            }
+        if present {
+            cm.log.WithFields(pullFields).Debug("Image already present")
+            return nil
         }
 
     }
-    cm.log.WithFields(pullFields).Info("Pulling image now")
-    out, err := cm.client.ImagePull(ctx, dockerImage, image.PullOptions{})
+    auth, err := cm.registry.Lookup(ctx, named)
     if err != nil {
+        return fmt.Errorf("failed to get registry credentials: %w", err)
+    }
+
+    cm.log.WithFields(pullFields).Info("Pulling image now")
+    if err := cm.runtime.PullImage(ctx, named.String(), auth); err != nil {
         return fmt.Errorf("failed to pull image: %w", err)
     }
-    defer out.Close()
     cm.log.WithFields(pullFields).Info("Pulled image")
     return nil
 }
 
 func (cm *ContainerManager) createContainer(ctx context.Context, cfg ContainerConfig) (string, error) {
-    err := cm.pullImage(ctx, cfg.Image)
-    if err != nil {
-        return "", fmt.Errorf("failed to pull image: %w", err)
-    }
-
-    // env is not set for all session
-    // env is set via container exec/attach
-    env := make([]string, 0)
-    devices := cm.config.DockerDevices
-    capAdd := cm.config.DockerCapAdd
-    secOpt := cm.config.DockerSecurityOpt
-
     volumeName, err := cm.CreateVFSMount(ctx, cfg)
     if err != nil {
         return "", fmt.Errorf("failed to create VFS mount: %w", err)
     }
 
-    containerConfig := &container.Config{
-        Image:     cfg.Image,
-        Env:       env,
-        Cmd:       cfg.Cmd,
-        OpenStdin: true,
-        Labels: map[string]string{
-            "de.mc8051.sshcontainer":      "true",
-            "de.mc8051.sshcontainer.user": cfg.User,
-        },
+    workspaceMount := Mount{
+        Type:   MountVolume,
+        Source: volumeName,
+        Target: cfg.Entry.MountPath,
     }
-
-    containerFields := logrus.Fields{
-        "image":       cfg.Image,
-        "user":        cfg.User,
-        "networkMode": cm.config.NetworkMode,
-        "networks":    cm.config.Networks,
-        "devices":     devices,
-        "capAdd":      capAdd,
-        "secOpt":      secOpt,
+    spec, err := cm.containerSpec(cfg.Workspace.ContainerName(cm.config.InstanceID), cfg.Entry, workspaceMount, cfg.Limits, cm.managedLabels(map[string]string{
+        "de.mc8051.sshcontainer.user":      cfg.User,
+        "de.mc8051.sshcontainer.workspace": cfg.Workspace.Name,
+        "de.mc8051.sshcontainer.image":     cfg.Entry.Name,
+        "de.mc8051.sshcontainer.imageid":   cfg.Entry.ImageID,
+        "de.mc8051.sshcontainer.profile":   cfg.Limits.Profile,
+    }))
+    if err != nil {
+        return "", err
     }
+    spec.Cmd = cfg.Cmd
 
-    cm.log.WithFields(containerFields).Debug("Creating container")
+    if cm.config.UsernsPerUser {
+        if cm.uidMap == nil {
+            // Kubernetes assigns every pod with a private user namespace its own range
+            spec.UsernsMode = "private"
+        } else {
+            mapping, err := cm.uidMap.Range(cfg.User)
+            if err != nil {
+                return "", err
+            }
+            spec.IDMapping = &mapping
+        }
+    }
 
-    var devMappings []container.DeviceMapping
-    for _, dev := range devices {
-        devMappings = append(devMappings, container.DeviceMapping{
-            PathOnHost:        dev,
-            PathInContainer:   dev,
-            CgroupPermissions: "rwm",
-        })
+    // isolated containers only join their own network
+    if cfg.Network != "" {
+        spec.NetworkMode = cfg.Network
+        spec.Networks = []string{cfg.Network}
+        spec.Labels["de.mc8051.sshcontainer.network"] = cfg.Network
     }
 
-    mounts := make([]mount.Mount, 0)
-    mounts = append(mounts, mount.Mount{
-        Type:   mount.TypeVolume,
-        Source: volumeName,
-        Target: cm.config.ContainerVFSMountPath,
+    return cm.createFromSpec(ctx, spec, logrus.Fields{
+        "user":      cfg.User,
+        "workspace": cfg.Workspace.Name,
     })
-    mounts = append(mounts, mount.Mount{
-        Type:   mount.TypeTmpfs,
-        Target: "/tmp",
-        TmpfsOptions: &mount.TmpfsOptions{
-            SizeBytes: cm.config.quotaBytes,
-            Mode:      os.FileMode(1777),
-        },
+}
+
+// containerSpec builds the spec shared by all user containers with the workspace storage mounted
+func (cm *ContainerManager) containerSpec(name string, entry CatalogEntry, workspaceMount Mount, limits Limits, labels map[string]string) (ContainerSpec, error) {
+    // env is not set for all session
+    // env is set via container exec/attach
+    env := make([]string, 0)
+
+    mounts := make([]Mount, 0)
+    mounts = append(mounts, workspaceMount)
+    mounts = append(mounts, Mount{
+        Type:      MountTmpfs,
+        Target:    "/tmp",
+        SizeBytes: limits.TmpfsBytes,
+        Mode:      os.FileMode(1777),
     })
 
     for _, extraMount := range cm.config.ContainerExtraMounts {
         parts := strings.Split(extraMount, ":")
         if len(parts) != 2 && len(parts) != 3 {
-            return "", fmt.Errorf("invalid extra mount: %s", extraMount)
+            return ContainerSpec{}, fmt.Errorf("invalid extra mount: %s", extraMount)
         }
-        mounts = append(mounts, mount.Mount{
-            Type:     mount.TypeBind,
+        mounts = append(mounts, Mount{
+            Type:     MountBind,
             Source:   parts[0],
             Target:   parts[1],
             ReadOnly: len(parts) == 3 && parts[2] == "ro",
         })
     }
 
-    hostConfig := &container.HostConfig{
-        NetworkMode:    container.NetworkMode(cm.config.NetworkMode),
-        CapAdd:         capAdd,
-        SecurityOpt:    secOpt,
-        ReadonlyRootfs: cm.config.DockerReadOnly,
-        Mounts:         mounts,
-        Resources: container.Resources{
-            Memory:   cm.config.memoryLimitBytes,
-            NanoCPUs: cm.config.cpuLimitNano,
-            Devices:  devMappings,
-        },
+    security, err := cm.securityProfile(entry, limits)
+    if err != nil {
+        return ContainerSpec{}, err
     }
 
-    networkingConfig := &network.NetworkingConfig{}
-    endpointsConfig := make(map[string]*network.EndpointSettings)
+    return ContainerSpec{
+        Name:        name,
+        Image:       entry.Image,
+        Env:         env,
+        Labels:      labels,
+        Mounts:      mounts,
+        NetworkMode: cm.config.NetworkMode,
+        Networks:    cm.config.Networks,
+        Devices:     limits.Devices,
+        CapAdd:      limits.CapAdd,
+        SecurityOpt: cm.config.DockerSecurityOpt,
+        Security:    security,
+        ReadOnly:    cm.config.DockerReadOnly,
+        Resources:   limits.Resources,
+        UsernsMode:  cm.config.UsernsMode,
+    }, nil
+}
 
-    if len(cm.config.Networks) > 0 {
-        endpointsConfig[cm.config.Networks[0]] = &network.EndpointSettings{}
-        networkingConfig.EndpointsConfig = endpointsConfig
+// createFromSpec creates the container and connects it to the additional networks
+func (cm *ContainerManager) createFromSpec(ctx context.Context, spec ContainerSpec, containerFields logrus.Fields) (string, error) {
+    containerFields["image"] = spec.Image
+    containerFields["profile"] = spec.Labels["de.mc8051.sshcontainer.profile"]
+    containerFields["runtime"] = cm.runtime.Name()
+    containerFields["networkMode"] = spec.NetworkMode
+    containerFields["networks"] = spec.Networks
+    containerFields["devices"] = spec.Devices
+    containerFields["capAdd"] = spec.CapAdd
+    containerFields["secOpt"] = spec.SecurityOpt
+    containerFields["security"] = spec.Security.Name
+
+    if cm.config.DNSFilterListen != "" {
+        resolver, err := cm.resolverAddress(ctx, spec)
+        if err != nil {
+            return "", err
+        }
+        spec.DNS = []string{resolver}
+        containerFields["dns"] = spec.DNS
     }
 
-    resp, err := cm.client.ContainerCreate(ctx, containerConfig, hostConfig, networkingConfig, nil, fmt.Sprintf("sshcontainer-%s", cfg.User))
+    cm.log.WithFields(containerFields).Debug("Creating container")
+
+    containerID, err := cm.runtime.CreateContainer(ctx, spec)
     if err != nil {
         return "", fmt.Errorf("failed to create container: %w", err)
     }
 
-    containerFields["containerID"] = resp.ID
+    containerFields["containerID"] = containerID
 
-    if len(cm.config.Networks) > 1 {
+    if len(spec.Networks) > 1 {
         cm.log.WithFields(containerFields).Debug("Connecting to additional networks")
-        for _, networkName := range cm.config.Networks[1:] {
-            err := cm.client.NetworkConnect(ctx, networkName, resp.ID, &network.EndpointSettings{})
+        for _, networkName := range spec.Networks[1:] {
+            err := cm.runtime.ConnectNetwork(ctx, networkName, containerID, nil)
             if err != nil {
-                cm.client.ContainerRemove(ctx, resp.ID, container.RemoveOptions{Force: true})
+                cm.runtime.RemoveContainer(ctx, containerID)
                 return "", fmt.Errorf("failed to connect to network %s: %w", networkName, err)
             }
         }
     }
 
     cm.log.WithFields(containerFields).Info("Created container")
-    return resp.ID, nil
+    return containerID, nil
 }
 
-func (cm *ContainerManager) ReleaseContainer(username string) {
-    cm.log.WithFields(logrus.Fields{
-        "username": username,
-    }).Debug("Releasing container")
-    cm.containersMutex.RLock()
-    defer cm.containersMutex.RUnlock()
-
-    if ct, exists := cm.containers[username]; exists {
-        ct.mutex.Lock()
-        ct.ActiveStreams--
-        ct.LastUsed = time.Now()
-        ct.mutex.Unlock()
-    }
+// SubscribeNotices returns a channel receiving notices about the workspace
+// container, e.g. when it was killed, and a function to unsubscribe
+func (cm *ContainerManager) SubscribeNotices(ws Workspace) (<-chan string, func()) {
+    return cm.notices.Subscribe(ws.Key())
 }
 
-func (cm *ContainerManager) AttachToContainer(ctx context.Context, containerID string) (types.HijackedResponse, error) {
+func (cm *ContainerManager) AttachToContainer(ctx context.Context, containerID string) (Stream, error) {
     cm.log.WithFields(logrus.Fields{
         "containerID": containerID,
     }).Debug("Attaching to container")
-    return cm.client.ContainerAttach(ctx, containerID, container.AttachOptions{
-        Stream: true,
-        Stdin:  true,
-        Stdout: true,
-        Stderr: true,
-    })
+    return cm.runtime.AttachContainer(ctx, containerID)
 }
 
-func (cm *ContainerManager) ExecInContainer(ctx context.Context, containerID string, env []string, cmd []string, user string, isPty bool) (types.HijackedResponse, string, error) {
+func (cm *ContainerManager) ExecInContainer(ctx context.Context, containerID string, env []string, cmd []string, entry CatalogEntry, isPty bool) (Stream, string, error) {
     cm.log.WithFields(logrus.Fields{
         "containerID": containerID,
         "env":         env,
         "cmd":         cmd,
     }).Debug("Executing command in container")
-    execConfig := container.ExecOptions{
-        User:         user,
-        Tty:          isPty,
-        AttachStdin:  true,
-        AttachStderr: true,
-        AttachStdout: true,
-        Env:          env,
-        Cmd:          cmd,
-        WorkingDir:   cm.config.ContainerVFSMountPath,
-    }
-
-    execCreateResp, err := cm.client.ContainerExecCreate(ctx, containerID, execConfig)
-    if err != nil {
-        return types.HijackedResponse{}, "", fmt.Errorf("failed to create exec: %w", err)
+    if len(cmd) == 0 {
+        cmd = entry.Cmd
     }
 
-    execAttachResp, err := cm.client.ContainerExecAttach(ctx, execCreateResp.ID, container.ExecAttachOptions{
-        Tty: isPty,
-    })
-    if err != nil {
-        return types.HijackedResponse{}, "", fmt.Errorf("failed to attach to exec: %w", err)
+    // the owner of a claimed pooled container is not in its labels
+    cm.containersMutex.RLock()
+    if key, tracked := cm.containerKey(containerID); tracked && len(cm.containers[key].Env) > 0 {
+        env = append(append([]string{}, env...), cm.containers[key].Env...)
     }
-
-    return execAttachResp, execCreateResp.ID, nil
+    cm.containersMutex.RUnlock()
+
+    return cm.runtime.Exec(ctx, containerID, ExecSpec{
+        User:       entry.User,
+        Tty:        isPty,
+        Env:        env,
+        Cmd:        cmd,
+        WorkingDir: entry.MountPath,
+    })
 }
 
 func (cm *ContainerManager) ResizeExec(ctx context.Context, execID string, height, width uint16) error {
-    return cm.client.ContainerExecResize(ctx, execID, container.ResizeOptions{
-        Height: uint(height),
-        Width:  uint(width),
-    })
+    return cm.runtime.ResizeExec(ctx, execID, uint(height), uint(width))
+}
+
+func (cm *ContainerManager) ResizeContainer(ctx context.Context, containerID string, height, width uint16) error {
+    return cm.runtime.ResizeContainer(ctx, containerID, uint(height), uint(width))
 }
 
 func (cm *ContainerManager) Shutdown() {
     close(cm.shutdownChan)
     cm.CleanUpContainers(context.Background())
+    if cm.pool != nil {
+        cm.pool.Shutdown(context.Background())
+    }
 }
 
 func (cm *ContainerManager) CleanUpContainers(ctx context.Context) error {
     cm.log.Info("Cleaning up all containers")
 
-    filterArgs := filters.NewArgs()
-    filterArgs.Add("label", "de.mc8051.sshcontainer=true")
-
-    containers, err := cm.client.ContainerList(ctx, container.ListOptions{
-        All:     true,
-        Filters: filterArgs,
-    })
+    containers, err := cm.runtime.ListContainers(ctx, cm.managedLabels(nil))
     if err != nil {
         return fmt.Errorf("failed to list containers: %w", err)
     }
 
     for _, c := range containers {
-        username := c.Labels["de.mc8051.sshcontainer.user"]
-        if err := cm.removeContainer(ctx, username); err != nil {
+        if !cm.ownedByInstance(c.Labels) {
+            continue
+        }
+        cm.containersMutex.RLock()
+        key, tracked := cm.containerKey(c.ID)
+        var user string
+        if tracked {
+            user = cm.containers[key].User
+        }
+        cm.containersMutex.RUnlock()
+        if !tracked {
+            continue
+        }
+
+        unlock := cm.userLocks.Lock(user)
+        err := cm.removeContainer(ctx, key)
+        unlock()
+        if err != nil {
             cm.log.WithError(err).Error("Failed to remove container during cleanup")
         }
     }
@@ -427,40 +1009,239 @@ func (cm *ContainerManager) CleanUpContainers(ctx context.Context) error {
     return nil
 }
 
-func (cm *ContainerManager) removeContainer(ctx context.Context, username string) error {
-    if ct, exists := cm.containers[username]; exists {
-        cm.log.WithFields(logrus.Fields{
-            "username":    username,
-            "containerID": ct.ID,
-        }).Info("Removing container")
-        if err := cm.client.ContainerRemove(ctx, ct.ID, container.RemoveOptions{
-            Force:         true,
-            RemoveVolumes: true,
-        }); err != nil {
-            return fmt.Errorf("failed to remove container: %w", err)
+// containerKey returns the workspace key of a tracked container. Pooled containers
+// have no user labels, so they can only be found by ID.
+func (cm *ContainerManager) containerKey(id string) (string, bool) {
+    for key, ct := range cm.containers {
+        if ct.ID == id {
+            return key, true
         }
+    }
+    return "", false
+}
 
-        if err := cm.RemoveVFSMount(ctx, ContainerConfig{User: username}); err != nil {
-            return fmt.Errorf("failed to remove vfs mount: %w", err)
+// removeContainer removes the container of the workspace key with its volume.
+// It is untracked first, so sessions and the event handler do not use it while
+// it is removed. The caller must hold the lock of the user.
+func (cm *ContainerManager) removeContainer(ctx context.Context, key string) error {
+    cm.containersMutex.Lock()
+    ct, exists := cm.containers[key]
+    if exists {
+        delete(cm.containers, key)
+        // reconcile must not adopt it and the network is still in use
+        cm.pending[key] = ct.Network
+    }
+    cm.containersMutex.Unlock()
+    if !exists {
+        return nil
+    }
+
+    defer func() {
+        cm.containersMutex.Lock()
+        delete(cm.pending, key)
+        if ct.Network != "" {
+            cm.releaseNetwork(ctx, ct.Network)
+        }
+        cm.containersMutex.Unlock()
+    }()
+
+    cm.log.WithFields(logrus.Fields{
+        "username":    ct.User,
+        "workspace":   ct.Workspace,
+        "containerID": ct.ID,
+    }).Info("Removing container")
+    if err := cm.runtime.RemoveContainer(ctx, ct.ID); err != nil {
+        // keep tracking it, the idle cleanup tries again
+        cm.containersMutex.Lock()
+        if _, replaced := cm.containers[key]; !replaced {
+            cm.track(key, ct)
         }
+        cm.containersMutex.Unlock()
+        return fmt.Errorf("failed to remove container: %w", err)
+    }
+
+    if ct.PoolSlot != "" && cm.pool != nil {
+        cm.pool.release(ct.PoolSlot)
+    }
 
-        delete(cm.containers, username)
+    ws := Workspace{User: ct.User, Name: ct.Workspace}
+    if err := cm.RemoveVFSMount(ctx, ContainerConfig{User: ct.User, Workspace: ws}); err != nil {
+        return fmt.Errorf("failed to remove vfs mount: %w", err)
     }
     return nil
 }
 
-func (cm *ContainerManager) CreateVFSMount(ctx context.Context, cfg ContainerConfig) (string, error) {
-    userVFS := path.Join("/mnt/vfs", cfg.User)
-    volumeName := fmt.Sprintf("sshcontainer-vfs-%s", cfg.User)
+// egressRules returns the egress rules of the container of the workspace key.
+// It reports false if the workspace has no container.
+func (cm *ContainerManager) egressRules(key string) (Egress, bool) {
+    cm.containersMutex.RLock()
+    defer cm.containersMutex.RUnlock()
+
+    ct, exists := cm.containers[key]
+    if !exists {
+        return Egress{}, false
+    }
+    return cm.containerEgress(ct), true
+}
+
+// egressRulesByAddress returns the workspace key and egress rules of the
+// container with the IP address. It reports false for unknown addresses.
+func (cm *ContainerManager) egressRulesByAddress(ip string) (string, Egress, bool) {
+    cm.containersMutex.RLock()
+    defer cm.containersMutex.RUnlock()
+
+    for key, ct := range cm.containers {
+        ct.mutex.Lock()
+        found := slices.Contains(ct.Addresses, ip)
+        ct.mutex.Unlock()
+        if found {
+            return key, cm.containerEgress(ct), true
+        }
+    }
+    return "", Egress{}, false
+}
+
+func (cm *ContainerManager) containerEgress(ct *UserContainer) Egress {
+    ct.mutex.Lock()
+    defer ct.mutex.Unlock()
+    if ct.Limits.Profile == "" {
+        // adopted containers keep the default limits
+        return cm.policy.Default().Egress
+    }
+    return ct.Limits.Egress
+}
+
+// ContainerStatus returns a short human readable state of the workspace container
+func (cm *ContainerManager) ContainerStatus(ws Workspace) string {
+    cm.containersMutex.RLock()
+    defer cm.containersMutex.RUnlock()
+
+    ct, exists := cm.containers[ws.Key()]
+    if !exists {
+        return "not running"
+    }
+
+    ct.mutex.Lock()
+    defer ct.mutex.Unlock()
+    switch ct.State {
+    case "paused":
+        return "paused"
+    case "exited":
+        return "stopped"
+    }
+    return fmt.Sprintf("running, %d active session(s)", cm.activeLeases(ct))
+}
+
+// QuotaUsage returns the used bytes and the quota limit of the workspace VFS.
+// A limit of 0 means no limit is set.
+func (cm *ContainerManager) QuotaUsage(ws Workspace) (uint64, uint64, error) {
+    if cm.storage != nil {
+        return 0, uint64(cm.config.quotaBytes), ErrUsageUnavailable
+    }
+
+    userVFS := path.Join(vfsRoot, cm.subvolumePath(ws))
+
+    out, err := exec.Command("btrfs", "qgroup", "show", "-reF", "--raw", userVFS).Output()
+    if err != nil {
+        return 0, 0, fmt.Errorf("failed to show qgroup: %w", err)
+    }
+
+    lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+    fields := strings.Fields(lines[len(lines)-1])
+    if len(fields) < 4 {
+        return 0, 0, fmt.Errorf("unexpected qgroup output: %s", out)
+    }
+
+    used, err := strconv.ParseUint(fields[1], 10, 64)
+    if err != nil {
+        return 0, 0, fmt.Errorf("invalid qgroup usage: %w", err)
+    }
+
+    var limit uint64
+    if fields[3] != "none" {
+        limit, err = strconv.ParseUint(fields[3], 10, 64)
+        if err != nil {
+            return 0, 0, fmt.Errorf("invalid qgroup limit: %w", err)
+        }
+    }
+
+    return used, limit, nil
+}
+
+// checkWorkspaceLimit fails if creating the workspace would exceed the per-user workspace limit
+func (cm *ContainerManager) checkWorkspaceLimit(ws Workspace) error {
+    if cm.config.MaxWorkspaces <= 0 {
+        return nil
+    }
+
+    workspaces, err := cm.ListWorkspaces(context.Background(), ws.User)
+    if err != nil {
+        return err
+    }
+
+    for _, existing := range workspaces {
+        if existing.Key() == ws.Key() {
+            return nil
+        }
+    }
+
+    if len(workspaces) >= cm.config.MaxWorkspaces {
+        return fmt.Errorf("workspace limit of %d reached for user %s", cm.config.MaxWorkspaces, ws.User)
+    }
+    return nil
+}
+
+// ListWorkspaces returns all workspaces of the user that have storage
+func (cm *ContainerManager) ListWorkspaces(ctx context.Context, user string) ([]Workspace, error) {
+    if cm.storage == nil {
+        workspaces, err := ListWorkspaces(cm.vfsDir(), user)
+        if err != nil || cm.config.InstanceID != "" {
+            return workspaces, err
+        }
+        // subvolumes created by older releases
+        legacy, err := ListWorkspaces(vfsRoot, user)
+        if err != nil {
+            return nil, err
+        }
+        for _, ws := range legacy {
+            if !slices.ContainsFunc(workspaces, func(w Workspace) bool { return w.Key() == ws.Key() }) {
+                workspaces = append(workspaces, ws)
+            }
+        }
+        sortWorkspaces(workspaces)
+        return workspaces, nil
+    }
+
+    volumes, err := cm.storage.ListVolumes(ctx, cm.managedLabels(map[string]string{
+        "de.mc8051.sshcontainer.user": user,
+    }))
+    if err != nil {
+        return nil, fmt.Errorf("failed to list volumes: %w", err)
+    }
+
+    workspaces := make([]Workspace, 0, len(volumes))
+    for _, volume := range volumes {
+        if !cm.ownedByInstance(volume.Labels) {
+            continue
+        }
+        workspaces = append(workspaces, WorkspaceFromLabels(volume.Labels))
+    }
+    sortWorkspaces(workspaces)
+    return workspaces, nil
+}
+
+// createSubvolume creates the btrfs subvolume of the workspace if needed and applies the quota
+func (cm *ContainerManager) createSubvolume(cfg ContainerConfig) (string, error) {
+    userVFS := path.Join(vfsRoot, cm.subvolumePath(cfg.Workspace))
 
     fields := logrus.Fields{
-        "user":        cfg.User,
-        "userVFS":     userVFS,
-        "blockDevice": cm.blockDevice,
-        "volumeName":  volumeName,
+        "user":      cfg.User,
+        "workspace": cfg.Workspace.Name,
+        "userVFS":   userVFS,
     }
 
     // check if userVFS already exists
+    created := false
     _, err := os.Stat(userVFS)
     if err != nil {
         if os.IsNotExist(err) {
@@ -470,23 +1251,75 @@ func (cm *ContainerManager) CreateVFSMount(ctx context.Context, cfg ContainerCon
                 return "", fmt.Errorf("failed to create user VFS: %w", err)
             }
             cm.log.WithFields(fields).Info("Created user VFS")
+            created = true
         } else {
             return "", fmt.Errorf("failed to stat user VFS: %w", err)
         }
     }
 
     // enable quota using btrfs qgroup limit size /volume/subvolume
-    if err := exec.Command("btrfs", "qgroup", "limit", cm.config.Quota, userVFS).Run(); err != nil {
+    quota := strconv.FormatInt(cfg.Limits.QuotaBytes, 10)
+    if err := exec.Command("btrfs", "qgroup", "limit", quota, userVFS).Run(); err != nil {
         return "", fmt.Errorf("failed to enable quota: %w", err)
     }
     cm.log.WithFields(fields).Info("Updated quota")
 
+    if err := cm.chownWorkspace(cfg.User, userVFS); err != nil {
+        return "", err
+    }
+    if err := cm.seedWorkspace(cfg.User, userVFS, cfg.Entry, created); err != nil {
+        return "", err
+    }
+    return userVFS, nil
+}
+
+// workspaceExists reports whether the storage of the workspace was created before
+func (cm *ContainerManager) workspaceExists(ctx context.Context, ws Workspace) (bool, error) {
+    if cm.storage != nil {
+        exists, err := cm.runtime.VolumeExists(ctx, ws.VolumeName(cm.config.InstanceID))
+        if err != nil {
+            return false, fmt.Errorf("failed to inspect volume: %w", err)
+        }
+        return exists, nil
+    }
+
+    _, err := os.Stat(path.Join(vfsRoot, cm.subvolumePath(ws)))
+    if os.IsNotExist(err) {
+        return false, nil
+    } else if err != nil {
+        return false, fmt.Errorf("failed to stat user VFS: %w", err)
+    }
+    return true, nil
+}
+
+func (cm *ContainerManager) CreateVFSMount(ctx context.Context, cfg ContainerConfig) (string, error) {
+    if cm.storage != nil {
+        return cm.createManagedVolume(ctx, cfg)
+    }
+
+    userVFS, err := cm.createSubvolume(cfg)
+    if err != nil {
+        return "", err
+    }
+    volumeName := cfg.Workspace.VolumeName(cm.config.InstanceID)
+
+    fields := logrus.Fields{
+        "user":        cfg.User,
+        "workspace":   cfg.Workspace.Name,
+        "userVFS":     userVFS,
+        "blockDevice": cm.blockDevice,
+        "volumeName":  volumeName,
+    }
+
     // check if volume already exists
-    _, err = cm.client.VolumeInspect(ctx, volumeName)
-    if err == nil {
+    exists, err := cm.runtime.VolumeExists(ctx, volumeName)
+    if err != nil {
+        return "", fmt.Errorf("failed to inspect volume: %w", err)
+    }
+    if exists {
         cm.log.WithFields(fields).Debug("Volume already exists")
         // delete volume
-        err = cm.client.VolumeRemove(ctx, volumeName, true)
+        err = cm.runtime.RemoveVolume(ctx, volumeName)
         if err != nil {
             return "", fmt.Errorf("failed to remove existing volume: %w", err)
         }
@@ -495,14 +1328,15 @@ func (cm *ContainerManager) CreateVFSMount(ctx context.Context, cfg ContainerCon
 
     cm.log.WithFields(fields).Debug("Creating volume")
 
-    _, err = cm.client.VolumeCreate(ctx, volume.CreateOptions{
+    err = cm.runtime.CreateVolume(ctx, VolumeSpec{
         Name:   volumeName,
         Driver: "local",
         DriverOpts: map[string]string{
             "type":   "btrfs",
             "device": cm.blockDevice,
-            "o":      fmt.Sprintf("subvol=%s", cfg.User),
+            "o":      fmt.Sprintf("subvol=%s", cm.subvolumePath(cfg.Workspace)),
         },
+        SizeBytes: cfg.Limits.QuotaBytes,
     })
     if err != nil {
         return "", fmt.Errorf("failed to create volume: %w", err)
@@ -512,18 +1346,50 @@ func (cm *ContainerManager) CreateVFSMount(ctx context.Context, cfg ContainerCon
     return volumeName, nil
 }
 
+// createManagedVolume creates the persistent volume of the workspace if it does not exist.
+// The quota is requested as storage size.
+func (cm *ContainerManager) createManagedVolume(ctx context.Context, cfg ContainerConfig) (string, error) {
+    volumeName := cfg.Workspace.VolumeName(cm.config.InstanceID)
+
+    err := cm.runtime.CreateVolume(ctx, VolumeSpec{
+        Name: volumeName,
+        Labels: cm.managedLabels(map[string]string{
+            "de.mc8051.sshcontainer.user":      cfg.User,
+            "de.mc8051.sshcontainer.workspace": cfg.Workspace.Name,
+        }),
+        SizeBytes: cfg.Limits.QuotaBytes,
+    })
+    if err != nil {
+        return "", fmt.Errorf("failed to create volume: %w", err)
+    }
+
+    cm.log.WithFields(logrus.Fields{
+        "user":       cfg.User,
+        "workspace":  cfg.Workspace.Name,
+        "volumeName": volumeName,
+        "runtime":    cm.runtime.Name(),
+    }).Debug("Ensured volume")
+    return volumeName, nil
+}
+
 func (cm *ContainerManager) RemoveVFSMount(ctx context.Context, cfg ContainerConfig) error {
-    volumeName := fmt.Sprintf("sshcontainer-vfs-%s", cfg.User)
+    volumeName := cfg.Workspace.VolumeName(cm.config.InstanceID)
+
+    // managed volumes hold the workspace data and outlive the container
+    if cm.storage != nil {
+        return nil
+    }
 
     fields := logrus.Fields{
         "user":        cfg.User,
+        "workspace":   cfg.Workspace.Name,
         "blockdevice": cm.blockDevice,
         "volumeName":  volumeName,
     }
 
     // ignore error explicitly - volume already deleted in removeContainer using RemoveVolumes: true
     // here we just want to make sure it's gone
-    _ = cm.client.VolumeRemove(ctx, volumeName, true)
+    _ = cm.runtime.RemoveVolume(ctx, volumeName)
 
     cm.log.WithFields(fields).Info("Removed volume")
     return nil
@@ -0,0 +1,467 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fakeRuntime keeps containers in memory. Pulls, creates, starts and removals
+// take delay. The hooks are called if they are set: pull and remove before the
+// call, listed after the list of containers is taken.
+type fakeRuntime struct {
+	Runtime
+
+	delay  time.Duration
+	images atomic.Int32 // bumped to move every tag to a new image
+	pull   func(ctx context.Context, ref string) error
+	remove func(ctx context.Context, id string) error
+	listed func()
+
+	mutex      sync.Mutex
+	next       int
+	containers map[string]ContainerInfo
+	removes    atomic.Int32
+	networks   []string // removed networks
+}
+
+func newFakeRuntime(delay time.Duration) *fakeRuntime {
+	return &fakeRuntime{delay: delay, containers: make(map[string]ContainerInfo)}
+}
+
+func (f *fakeRuntime) wait(ctx context.Context) error {
+	select {
+	case <-time.After(f.delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *fakeRuntime) Name() string {
+	return "fake"
+}
+
+func (f *fakeRuntime) PullImage(ctx context.Context, ref string, auth *RegistryAuth) error {
+	if f.pull != nil {
+		if err := f.pull(ctx, ref); err != nil {
+			return err
+		}
+	}
+	return f.wait(ctx)
+}
+
+func (f *fakeRuntime) ImageExists(ctx context.Context, ref string) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeRuntime) InspectImage(ctx context.Context, ref string) (ImageInfo, error) {
+	return ImageInfo{ID: fmt.Sprintf("sha256:%s-%d", ref, f.images.Load())}, nil
+}
+
+func (f *fakeRuntime) CreateContainer(ctx context.Context, spec ContainerSpec) (string, error) {
+	if err := f.wait(ctx); err != nil {
+		return "", err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, c := range f.containers {
+		if c.Name == spec.Name {
+			return "", fmt.Errorf("container name %s is already in use", spec.Name)
+		}
+	}
+	f.next++
+	id := fmt.Sprintf("c%d", f.next)
+	f.containers[id] = ContainerInfo{
+		ID:      id,
+		Name:    spec.Name,
+		Image:   spec.Image,
+		State:   "created",
+		Labels:  spec.Labels,
+		Network: map[string]string{"bridge": fmt.Sprintf("10.0.%d.%d", f.next/256, f.next%256)},
+	}
+	return id, nil
+}
+
+// setState changes the state of an existing container
+func (f *fakeRuntime) setState(id, state string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	c, exists := f.containers[id]
+	if !exists {
+		return fmt.Errorf("%w: container %s", ErrNotFound, id)
+	}
+	c.State = state
+	f.containers[id] = c
+	return nil
+}
+
+func (f *fakeRuntime) StartContainer(ctx context.Context, id string) error {
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+	return f.setState(id, "running")
+}
+
+func (f *fakeRuntime) PauseContainer(ctx context.Context, id string) error {
+	return f.setState(id, "paused")
+}
+
+func (f *fakeRuntime) UnpauseContainer(ctx context.Context, id string) error {
+	return f.setState(id, "running")
+}
+
+func (f *fakeRuntime) StopContainer(ctx context.Context, id string) error {
+	return f.setState(id, "exited")
+}
+
+func (f *fakeRuntime) InspectContainer(ctx context.Context, id string) (ContainerInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	c, exists := f.containers[id]
+	if !exists {
+		return ContainerInfo{}, fmt.Errorf("%w: container %s", ErrNotFound, id)
+	}
+	return c, nil
+}
+
+func (f *fakeRuntime) ListContainers(ctx context.Context, labels map[string]string) ([]ContainerInfo, error) {
+	f.mutex.Lock()
+	result := make([]ContainerInfo, 0, len(f.containers))
+	for _, c := range f.containers {
+		result = append(result, c)
+	}
+	f.mutex.Unlock()
+
+	if f.listed != nil {
+		f.listed()
+	}
+	return result, nil
+}
+
+func (f *fakeRuntime) RemoveContainer(ctx context.Context, id string) error {
+	if f.remove != nil {
+		if err := f.remove(ctx, id); err != nil {
+			return err
+		}
+	}
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+	f.removes.Add(1)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.containers, id)
+	return nil
+}
+
+// running reports whether the container exists and runs
+func (f *fakeRuntime) running(id string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.containers[id].State == "running"
+}
+
+// exists reports whether the container exists
+func (f *fakeRuntime) exists(id string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, exists := f.containers[id]
+	return exists
+}
+
+func (f *fakeRuntime) RemoveNetwork(ctx context.Context, name string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.networks = append(f.networks, name)
+	return nil
+}
+
+// removedNetworks returns the networks removed so far
+func (f *fakeRuntime) removedNetworks() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.networks...)
+}
+
+func (f *fakeRuntime) CreateVolume(ctx context.Context, spec VolumeSpec) error {
+	return nil
+}
+
+func (f *fakeRuntime) VolumeExists(ctx context.Context, name string) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeRuntime) RemoveVolume(ctx context.Context, name string) error {
+	return nil
+}
+
+func (f *fakeRuntime) ListVolumes(ctx context.Context, labels map[string]string) ([]VolumeInfo, error) {
+	return nil, nil
+}
+
+var testEntry = CatalogEntry{
+	Name:            "default",
+	Image:           "ubuntu:22.04",
+	MountPath:       "/workspace",
+	User:            "user",
+	Cmd:             []string{"/bin/bash"},
+	SecurityProfile: "default",
+}
+
+// newTestManager returns a manager on the fake runtime with managed storage,
+// so no btrfs is needed
+func newTestManager(rt *fakeRuntime) *ContainerManager {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return &ContainerManager{
+		runtime: rt,
+		config: &Config{
+			ImageUpdatePolicy:     "off",
+			DockerImagePullPolicy: "unless-present",
+		},
+		catalog:     &ImageCatalog{Entries: []CatalogEntry{testEntry}},
+		policy:      &Policy{},
+		log:         log,
+		containers:  make(map[string]*UserContainer),
+		pending:     make(map[string]string),
+		userLocks:   newKeyedMutex(),
+		storage:     rt,
+		notices:     newNoticeBoard(),
+		registry:    &RegistryCredentials{},
+		imageChecks: newImageChecks(),
+	}
+}
+
+func login(t testing.TB, cm *ContainerManager, ws Workspace) *Lease {
+	t.Helper()
+	lease, _, err := cm.GetOrCreateContainer(context.Background(), ws, testEntry, Limits{}, nil)
+	if err != nil {
+		t.Fatalf("login of %s failed: %v", ws.Key(), err)
+	}
+	return lease
+}
+
+// blockPulls makes pulls of the image wait until the returned function is
+// called. The channel receives a value when a pull starts.
+func blockPulls(rt *fakeRuntime, image string) (<-chan struct{}, func()) {
+	started := make(chan struct{}, 1)
+	gate := make(chan struct{})
+	rt.pull = func(ctx context.Context, ref string) error {
+		if !strings.HasSuffix(ref, "/"+image) {
+			return nil
+		}
+		started <- struct{}{}
+		select {
+		case <-gate:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return started, func() { close(gate) }
+}
+
+// waitFor fails the test if the function does not return within a second
+func waitFor(t *testing.T, what string, fn func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s is blocked", what)
+	}
+}
+
+func TestGetOrCreateContainerReusesContainer(t *testing.T) {
+	rt := newFakeRuntime(0)
+	cm := newTestManager(rt)
+	ws := Workspace{User: "alice", Name: DefaultWorkspace}
+
+	first := login(t, cm, ws)
+	second := login(t, cm, ws)
+	if first.ContainerID != second.ContainerID {
+		t.Errorf("second login got container %s, want %s", second.ContainerID, first.ContainerID)
+	}
+	if !rt.running(first.ContainerID) {
+		t.Errorf("container %s is not running", first.ContainerID)
+	}
+	if status := cm.ContainerStatus(ws); status != "running, 2 active session(s)" {
+		t.Errorf("status = %q", status)
+	}
+
+	cm.ReleaseContainer(first)
+	cm.ReleaseContainer(second)
+	if status := cm.ContainerStatus(ws); status != "running, 0 active session(s)" {
+		t.Errorf("status after release = %q", status)
+	}
+}
+
+func TestGetOrCreateContainerResumesPausedContainer(t *testing.T) {
+	rt := newFakeRuntime(0)
+	cm := newTestManager(rt)
+	ws := Workspace{User: "alice", Name: DefaultWorkspace}
+
+	lease := login(t, cm, ws)
+	cm.ReleaseContainer(lease)
+	ct := cm.containers[ws.Key()]
+	if err := cm.changeState(context.Background(), ct, "paused", rt.PauseContainer); err != nil {
+		t.Fatal(err)
+	}
+
+	lease = login(t, cm, ws)
+	defer cm.ReleaseContainer(lease)
+	if !rt.running(lease.ContainerID) {
+		t.Errorf("container %s was not unpaused", lease.ContainerID)
+	}
+	if status := cm.ContainerStatus(ws); status != "running, 1 active session(s)" {
+		t.Errorf("status = %q", status)
+	}
+}
+
+// A login waiting for the registry must not keep other sessions from looking up
+// the container, e.g. the proxy, the DNS filter and the event handler
+func TestSlowPullDoesNotBlockLookups(t *testing.T) {
+	rt := newFakeRuntime(0)
+	cm := newTestManager(rt)
+	ws := Workspace{User: "alice", Name: DefaultWorkspace}
+	lease := login(t, cm, ws)
+	defer cm.ReleaseContainer(lease)
+	info, err := rt.InspectContainer(context.Background(), lease.ContainerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the login to a new workspace pulls the image
+	cm.config.DockerImagePullPolicy = "always"
+	started, release := blockPulls(rt, testEntry.Image)
+	loggedIn := make(chan error, 1)
+	go func() {
+		lease, _, err := cm.GetOrCreateContainer(context.Background(), Workspace{User: "alice", Name: "dev"}, testEntry, Limits{}, nil)
+		if err == nil {
+			cm.ReleaseContainer(lease)
+		}
+		loggedIn <- err
+	}()
+	<-started
+
+	waitFor(t, "ContainerStatus", func() { cm.ContainerStatus(ws) })
+	waitFor(t, "egressRulesByAddress", func() {
+		if _, _, found := cm.egressRulesByAddress(info.Network["bridge"]); !found {
+			t.Errorf("no container with address %s", info.Network["bridge"])
+		}
+	})
+	waitFor(t, "handleEvent", func() { cm.handleEvent(ContainerEvent{ID: lease.ContainerID, Action: "start"}) })
+	waitFor(t, "cleanupIdleContainers", cm.cleanupIdleContainers)
+
+	release()
+	if err := <-loggedIn; err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+}
+
+// A login compares the image with the last update check and refreshes the
+// check in the background, it does not wait for the registry
+func TestImageUpdateCheckDoesNotBlockLogin(t *testing.T) {
+	rt := newFakeRuntime(0)
+	cm := newTestManager(rt)
+	cm.config.ImageUpdatePolicy = "strict"
+	cm.config.DockerImagePullPolicy = "always"
+	ws := Workspace{User: "alice", Name: DefaultWorkspace}
+	old := login(t, cm, ws)
+	cm.ReleaseContainer(old)
+
+	// the tag moves and the last check is due
+	rt.images.Add(1)
+	cm.imageChecks.mutex.Lock()
+	cm.imageChecks.images[testEntry.Image].checked = time.Time{}
+	cm.imageChecks.mutex.Unlock()
+	started, release := blockPulls(rt, testEntry.Image)
+
+	var lease *Lease
+	waitFor(t, "login", func() { lease = login(t, cm, ws) })
+	<-started
+	if lease.ContainerID != old.ContainerID {
+		t.Fatalf("login got container %s before the check finished, want %s", lease.ContainerID, old.ContainerID)
+	}
+	cm.ReleaseContainer(lease)
+
+	release()
+	for refreshing := true; refreshing; {
+		time.Sleep(time.Millisecond)
+		cm.imageChecks.mutex.Lock()
+		refreshing = cm.imageChecks.images[testEntry.Image].refreshing
+		cm.imageChecks.mutex.Unlock()
+	}
+
+	updated := login(t, cm, ws)
+	defer cm.ReleaseContainer(updated)
+	if updated.ContainerID == old.ContainerID {
+		t.Errorf("login after the check kept the outdated container %s", old.ContainerID)
+	}
+}
+
+func TestSlowLoginDoesNotBlockOtherUsers(t *testing.T) {
+	rt := newFakeRuntime(0)
+	cm := newTestManager(rt)
+	cm.config.DockerImagePullPolicy = "always"
+	slow := testEntry
+	slow.Image = "slow:latest"
+	started, release := blockPulls(rt, slow.Image)
+
+	loggedIn := make(chan error, 1)
+	go func() {
+		lease, _, err := cm.GetOrCreateContainer(context.Background(), Workspace{User: "alice", Name: DefaultWorkspace}, slow, Limits{}, nil)
+		if err == nil {
+			cm.ReleaseContainer(lease)
+		}
+		loggedIn <- err
+	}()
+	<-started
+
+	waitFor(t, "login of another user", func() {
+		cm.ReleaseContainer(login(t, cm, Workspace{User: "bob", Name: DefaultWorkspace}))
+	})
+
+	release()
+	if err := <-loggedIn; err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+}
+
+// BenchmarkGetOrCreateContainer logs in users for the first time while every
+// runtime call takes a millisecond. Logins of different users run in parallel,
+// so the time per login drops with the number of parallel logins.
+func BenchmarkGetOrCreateContainer(b *testing.B) {
+	for _, parallel := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("parallel=%d", parallel), func(b *testing.B) {
+			cm := newTestManager(newFakeRuntime(time.Millisecond))
+			cm.config.DockerImagePullPolicy = "always"
+			var users atomic.Int64
+
+			b.SetParallelism(parallel)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					ws := Workspace{User: fmt.Sprintf("user%d", users.Add(1)), Name: DefaultWorkspace}
+					lease, _, err := cm.GetOrCreateContainer(context.Background(), ws, testEntry, Limits{}, nil)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					cm.ReleaseContainer(lease)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTimeout     = 5 * time.Second
+	dnsSinkholeTTL = 60
+	// dnsMaxMessage is the largest DNS message, TCP messages are length prefixed with 16 bits
+	dnsMaxMessage = 65535
+)
+
+// DNSFilter is the resolver of user containers. It identifies the workspace by
+// the source address of a query, applies the egress rules of the user's
+// resource profile and forwards allowed queries to the upstream resolvers.
+type DNSFilter struct {
+	containers *ContainerManager
+	upstreams  []string
+	sinkhole   net.IP // nil to answer blocked names with NXDOMAIN
+	log        *logrus.Logger
+}
+
+func NewDNSFilter(config *Config, containers *ContainerManager, log *logrus.Logger) (*DNSFilter, error) {
+	upstreams := config.DNSFilterUpstreams
+	if len(upstreams) == 0 {
+		var err error
+		upstreams, err = systemResolvers("/etc/resolv.conf")
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, upstream := range upstreams {
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			upstreams[i] = net.JoinHostPort(upstream, "53")
+		}
+	}
+
+	var sinkhole net.IP
+	if config.DNSFilterSinkhole != "" {
+		sinkhole = net.ParseIP(config.DNSFilterSinkhole)
+		if sinkhole == nil {
+			return nil, fmt.Errorf("invalid DNS sinkhole address: %q", config.DNSFilterSinkhole)
+		}
+	}
+
+	return &DNSFilter{
+		containers: containers,
+		upstreams:  upstreams,
+		sinkhole:   sinkhole,
+		log:        log,
+	}, nil
+}
+
+// systemResolvers reads the nameservers of the server from resolv.conf
+func systemResolvers(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read resolvers: %w", err)
+	}
+	defer file.Close()
+
+	var resolvers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			resolvers = append(resolvers, fields[1])
+		}
+	}
+	if len(resolvers) == 0 {
+		return nil, fmt.Errorf("no nameserver in %s, set DNS_FILTER_UPSTREAMS", path)
+	}
+	return resolvers, scanner.Err()
+}
+
+// ListenAndServe answers queries over UDP and TCP on the address
+func (f *DNSFilter) ListenAndServe(addr string) error {
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on udp %s: %w", addr, err)
+	}
+	defer udp.Close()
+
+	tcp, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on tcp %s: %w", addr, err)
+	}
+	defer tcp.Close()
+
+	f.log.WithField("addr", addr).Info("Starting DNS filter")
+
+	errs := make(chan error, 2)
+	go func() { errs <- f.serveUDP(udp) }()
+	go func() { errs <- f.serveTCP(tcp) }()
+	return <-errs
+}
+
+func (f *DNSFilter) serveUDP(conn net.PacketConn) error {
+	for {
+		buf := make([]byte, dnsMaxMessage)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			remote, _ := addr.(*net.UDPAddr)
+			if remote == nil {
+				return
+			}
+			if resp := f.handle(buf[:n], remote.IP, "udp"); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (f *DNSFilter) serveTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+			remote, _ := conn.RemoteAddr().(*net.TCPAddr)
+			if remote == nil {
+				return
+			}
+
+			for {
+				conn.SetDeadline(time.Now().Add(dnsTimeout))
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				resp := f.handle(query, remote.IP, "tcp")
+				if resp == nil || writeTCPMessage(conn, resp) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, length)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// handle answers a query. It returns nil if the query cannot be parsed.
+func (f *DNSFilter) handle(query []byte, remote net.IP, network string) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil
+	}
+
+	name := strings.TrimSuffix(question.Name.String(), ".")
+	fields := logrus.Fields{
+		"remote": remote.String(),
+		"name":   name,
+		"type":   question.Type.String(),
+	}
+
+	key, egress, ok := f.containers.egressRulesByAddress(remote.String())
+	if !ok {
+		f.log.WithFields(fields).Warn("Refused DNS query of unknown client")
+		return f.reply(header, question, dnsmessage.RCodeRefused, nil)
+	}
+	user, workspace, _ := strings.Cut(key, workspaceSeparator)
+	if workspace == "" {
+		workspace = DefaultWorkspace
+	}
+	fields["user"] = user
+	fields["workspace"] = workspace
+
+	if !egress.Allows(name) {
+		f.log.WithFields(fields).Info("Blocked DNS query")
+		if f.sinkhole != nil {
+			return f.reply(header, question, dnsmessage.RCodeSuccess, f.sinkhole)
+		}
+		return f.reply(header, question, dnsmessage.RCodeNameError, nil)
+	}
+
+	resp, err := f.forward(query, network)
+	if err != nil {
+		f.log.WithFields(fields).WithError(err).Warn("DNS query failed")
+		return f.reply(header, question, dnsmessage.RCodeServerFailure, nil)
+	}
+	f.log.WithFields(fields).Info("Resolved DNS query")
+	return resp
+}
+
+// forward sends the query to the upstream resolvers until one answers
+func (f *DNSFilter) forward(query []byte, network string) ([]byte, error) {
+	var lastErr error
+	for _, upstream := range f.upstreams {
+		resp, err := exchange(query, network, upstream)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func exchange(query []byte, network, upstream string) ([]byte, error) {
+	conn, err := net.DialTimeout(network, upstream, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxMessage)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// reply builds an answer to the question with the sinkhole address if it
+// matches the query type
+func (f *DNSFilter) reply(query dnsmessage.Header, question dnsmessage.Question, rcode dnsmessage.RCode, sinkhole net.IP) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 query.ID,
+		Response:           true,
+		OpCode:             query.OpCode,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	builder.EnableCompression()
+
+	if err := builder.StartQuestions(); err != nil {
+		return nil
+	}
+	if err := builder.Question(question); err != nil {
+		return nil
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil
+	}
+
+	answer := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: dnsSinkholeTTL}
+	if ip4 := sinkhole.To4(); ip4 != nil && question.Type == dnsmessage.TypeA {
+		builder.AResource(answer, dnsmessage.AResource{A: [4]byte(ip4)})
+	} else if sinkhole != nil && ip4 == nil && question.Type == dnsmessage.TypeAAAA {
+		builder.AAAAResource(answer, dnsmessage.AAAAResource{AAAA: [16]byte(sinkhole.To16())})
+	}
+
+	msg, err := builder.Finish()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
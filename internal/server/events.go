@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const eventsRetryInterval = 5 * time.Second
+
+// watchEvents keeps the container map in sync with the lifecycle events of the
+// runtime and reconnects to the event stream after errors. Events missed while
+// disconnected are picked up by the periodic reconcile.
+func (cm *ContainerManager) watchEvents() {
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		events, errs := cm.runtime.Events(ctx, cm.managedLabels(nil))
+
+		err := cm.consumeEvents(events, errs)
+		cancel()
+		if err == nil {
+			return
+		}
+
+		cm.log.WithError(err).Warn("Container event stream failed, reconnecting")
+		select {
+		case <-time.After(eventsRetryInterval):
+		case <-cm.shutdownChan:
+			return
+		}
+	}
+}
+
+// consumeEvents handles events until the stream fails or the manager shuts down
+func (cm *ContainerManager) consumeEvents(events <-chan ContainerEvent, errs <-chan error) error {
+	for {
+		select {
+		case event := <-events:
+			cm.handleEvent(event)
+		case err := <-errs:
+			if err == nil {
+				err = fmt.Errorf("event stream closed")
+			}
+			return err
+		case <-cm.shutdownChan:
+			return nil
+		}
+	}
+}
+
+func (cm *ContainerManager) handleEvent(event ContainerEvent) {
+	cm.containersMutex.Lock()
+	defer cm.containersMutex.Unlock()
+
+	// containers removed by the manager itself are not tracked anymore
+	key, tracked := cm.containerKey(event.ID)
+	if !tracked {
+		return
+	}
+	ct := cm.containers[key]
+
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	fields := logrus.Fields{
+		"user":        ct.User,
+		"workspace":   ct.Workspace,
+		"containerID": ct.ID,
+		"action":      event.Action,
+	}
+
+	limits := ct.Limits
+	if limits.Profile == "" {
+		limits = cm.policy.Default()
+	}
+	outOfMemory := "out of memory"
+	if limits.Resources.MemoryBytes > 0 {
+		outOfMemory = fmt.Sprintf("out of memory at %s", FormatSize(uint64(limits.Resources.MemoryBytes)))
+	}
+
+	switch event.Action {
+	case "oom":
+		cm.log.WithFields(fields).Warn("Container ran out of memory")
+		ct.oomKilled = true
+		cm.notices.Notify(key, fmt.Sprintf("a process in your environment was killed: %s", outOfMemory))
+	case "die":
+		// stopped by the idle cleanup
+		if ct.State == "exited" {
+			return
+		}
+		cm.setState(ct, "exited")
+
+		reason := fmt.Sprintf("exited with code %d", event.ExitCode)
+		if ct.oomKilled {
+			reason = outOfMemory
+		}
+		ct.oomKilled = false
+
+		cm.log.WithFields(fields).WithField("reason", reason).Warn("Container died")
+		cm.notices.Notify(key, fmt.Sprintf("your environment was killed: %s", reason))
+	case "destroy":
+		cm.log.WithFields(fields).Warn("Container was removed externally, evicting")
+		delete(cm.containers, key)
+		if ct.Network != "" {
+			cm.releaseNetwork(context.Background(), ct.Network)
+		}
+		cm.notices.Notify(key, "your environment was removed")
+	case "pause":
+		cm.setState(ct, "paused")
+	case "unpause", "start":
+		cm.setState(ct, "running")
+	}
+}
+
+// noticeBoard delivers notices about a workspace to its live sessions. Notices
+// for workspaces without sessions are kept for the next login.
+type noticeBoard struct {
+	subscribers map[string]map[chan string]struct{} // map of workspace key to session channels
+	pending     map[string]string
+	mutex       sync.Mutex
+}
+
+func newNoticeBoard() *noticeBoard {
+	return &noticeBoard{
+		subscribers: make(map[string]map[chan string]struct{}),
+		pending:     make(map[string]string),
+	}
+}
+
+// Subscribe returns a channel receiving the notices of the workspace and a function to unsubscribe
+func (b *noticeBoard) Subscribe(key string) (<-chan string, func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ch := make(chan string, 4)
+	if notice, exists := b.pending[key]; exists {
+		ch <- notice
+		delete(b.pending, key)
+	}
+
+	if b.subscribers[key] == nil {
+		b.subscribers[key] = make(map[chan string]struct{})
+	}
+	b.subscribers[key][ch] = struct{}{}
+
+	return ch, func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		delete(b.subscribers[key], ch)
+		if len(b.subscribers[key]) == 0 {
+			delete(b.subscribers, key)
+		}
+	}
+}
+
+func (b *noticeBoard) Notify(key, notice string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.subscribers[key]) == 0 {
+		b.pending[key] = notice
+		return
+	}
+	for ch := range b.subscribers[key] {
+		select {
+		case ch <- notice:
+		default:
+			// the session is not reading, drop the notice
+		}
+	}
+}
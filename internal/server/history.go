@@ -0,0 +1,61 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const maxSessionHistory = 5
+
+// SessionRecord describes a past or running SSH session of a user
+type SessionRecord struct {
+	ID        string
+	Workspace Workspace
+	Remote    string
+	Command   []string
+	Started   time.Time
+	Ended     time.Time
+}
+
+// SessionHistory keeps the most recent sessions per user in memory
+type SessionHistory struct {
+	sessions map[string][]*SessionRecord
+	mutex    sync.RWMutex
+}
+
+func NewSessionHistory() *SessionHistory {
+	return &SessionHistory{
+		sessions: make(map[string][]*SessionRecord),
+	}
+}
+
+// Start records a new session and returns a function that marks it as ended
+func (h *SessionHistory) Start(username string, record *SessionRecord) func() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	records := append(h.sessions[username], record)
+	if len(records) > maxSessionHistory {
+		records = records[len(records)-maxSessionHistory:]
+	}
+	h.sessions[username] = records
+
+	return func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		record.Ended = time.Now()
+	}
+}
+
+// Recent returns copies of the user's sessions, newest first
+func (h *SessionHistory) Recent(username string) []SessionRecord {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	records := h.sessions[username]
+	result := make([]SessionRecord, 0, len(records))
+	for i := len(records) - 1; i >= 0; i-- {
+		result = append(result, *records[i])
+	}
+	return result
+}
@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/sirupsen/logrus"
+)
+
+// Hook events
+const (
+	HookWorkspaceCreated     = "workspace-created"
+	HookContainerCreated     = "container-created"
+	HookSessionStarted       = "session-started"
+	HookSessionEnded         = "session-ended"
+	HookContainerIdleRemoved = "container-idle-removed"
+)
+
+const (
+	defaultHookTimeout = 30 * time.Second
+	// hookOutputLimit is the length of the hook output kept for errors
+	hookOutputLimit = 1024
+)
+
+// fatalHookEvents happen before the session starts and can abort the login
+var fatalHookEvents = []string{HookWorkspaceCreated, HookContainerCreated, HookSessionStarted}
+
+const sessionContextKey = contextKey("session")
+
+// hookSession identifies the session that caused an event
+type hookSession struct {
+	ID     string
+	Claims Claims
+}
+
+// WithSession adds the session ID and claims to the context, hooks run with
+// the context pass them on
+func WithSession(ctx context.Context, id string, claims Claims) context.Context {
+	return context.WithValue(ctx, sessionContextKey, hookSession{ID: id, Claims: claims})
+}
+
+// Hook runs a command in the user container, a command on the server or an
+// HTTP request when an event happens
+type Hook struct {
+	Event   string   `json:"event"`
+	Exec    []string `json:"exec"`    // command run in the user container
+	User    string   `json:"user"`    // user of exec, defaults to the user of the image
+	Command []string `json:"command"` // command run on the server
+	URL     string   `json:"url"`     // receives the event as JSON in a POST request
+	Timeout string   `json:"timeout"`
+	Fatal   bool     `json:"fatal"` // abort the login if the hook fails
+
+	timeout time.Duration
+}
+
+// HookEvent is passed to hooks as environment variables or as the JSON body
+type HookEvent struct {
+	Event       string `json:"event"`
+	User        string `json:"user"`
+	Workspace   string `json:"workspace"`
+	Image       string `json:"image"`
+	ContainerID string `json:"containerId"`
+	SessionID   string `json:"sessionId,omitempty"`
+	Claims      Claims `json:"claims,omitempty"`
+}
+
+// Env returns the event as environment variables
+func (e HookEvent) Env() []string {
+	claims, _ := json.Marshal(e.Claims)
+	return []string{
+		"SSHCONTAINER_EVENT=" + e.Event,
+		"SSHCONTAINER_USER=" + e.User,
+		"SSHCONTAINER_WORKSPACE=" + e.Workspace,
+		"SSHCONTAINER_IMAGE=" + e.Image,
+		"SSHCONTAINER_CONTAINER_ID=" + e.ContainerID,
+		"SSHCONTAINER_SESSION_ID=" + e.SessionID,
+		"SSHCONTAINER_CLAIMS=" + string(claims),
+	}
+}
+
+// LoadHooks reads the hooks file. Without a file no hooks run.
+func LoadHooks(path string) ([]Hook, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hooks file: %w", err)
+	}
+	var hooks []Hook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return nil, fmt.Errorf("failed to parse hooks file: %w", err)
+	}
+
+	for i := range hooks {
+		if err := hooks[i].validate(); err != nil {
+			return nil, fmt.Errorf("hook %d: %w", i, err)
+		}
+	}
+	return hooks, nil
+}
+
+func (h *Hook) validate() error {
+	switch h.Event {
+	case HookWorkspaceCreated, HookContainerCreated, HookSessionStarted, HookSessionEnded, HookContainerIdleRemoved:
+	default:
+		return fmt.Errorf("unknown event %q", h.Event)
+	}
+
+	actions := 0
+	for _, set := range []bool{len(h.Exec) > 0, len(h.Command) > 0, h.URL != ""} {
+		if set {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return fmt.Errorf("set exactly one of exec, command and url")
+	}
+	if len(h.Exec) > 0 && h.Event == HookContainerIdleRemoved {
+		return fmt.Errorf("exec is not possible after the container is removed")
+	}
+	if h.Fatal && !slices.Contains(fatalHookEvents, h.Event) {
+		return fmt.Errorf("%s hooks cannot abort the login", h.Event)
+	}
+
+	h.timeout = defaultHookTimeout
+	if h.Timeout != "" {
+		timeout, err := time.ParseDuration(h.Timeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid timeout: %q", h.Timeout)
+		}
+		h.timeout = timeout
+	}
+	return nil
+}
+
+// RunHooks runs the hooks of the event in order. Failures of fatal hooks are
+// returned, the others are only logged.
+func (cm *ContainerManager) RunHooks(ctx context.Context, event string, ws Workspace, containerID string, entry CatalogEntry) error {
+	hookEvent := HookEvent{
+		Event:       event,
+		User:        ws.User,
+		Workspace:   ws.Name,
+		Image:       entry.Name,
+		ContainerID: containerID,
+	}
+	if session, ok := ctx.Value(sessionContextKey).(hookSession); ok {
+		hookEvent.SessionID = session.ID
+		hookEvent.Claims = session.Claims
+	}
+
+	for i, hook := range cm.hooks {
+		if hook.Event != event {
+			continue
+		}
+
+		fields := logrus.Fields{
+			"event":       event,
+			"hook":        i,
+			"user":        ws.User,
+			"workspace":   ws.Name,
+			"containerID": containerID,
+		}
+		hookCtx, cancel := context.WithTimeout(ctx, hook.timeout)
+		err := cm.runHook(hookCtx, hook, hookEvent, entry)
+		cancel()
+		if err != nil && hook.Fatal {
+			cm.log.WithFields(fields).WithError(err).Error("Hook failed")
+			return fmt.Errorf("%s hook failed: %w", event, err)
+		} else if err != nil {
+			cm.log.WithFields(fields).WithError(err).Warn("Hook failed")
+		} else {
+			cm.log.WithFields(fields).Debug("Hook succeeded")
+		}
+	}
+	return nil
+}
+
+func (cm *ContainerManager) runHook(ctx context.Context, hook Hook, event HookEvent, entry CatalogEntry) error {
+	switch {
+	case len(hook.Exec) > 0:
+		user := hook.User
+		if user == "" {
+			user = entry.User
+		}
+		stream, execID, err := cm.runtime.Exec(ctx, event.ContainerID, ExecSpec{
+			Cmd:        hook.Exec,
+			Env:        event.Env(),
+			User:       user,
+			WorkingDir: entry.MountPath,
+		})
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		// streams do not end with the context
+		stop := context.AfterFunc(ctx, func() { stream.Close() })
+		defer stop()
+		stream.CloseWrite()
+
+		var output bytes.Buffer
+		if _, err := stdcopy.StdCopy(&output, &output, stream); err != nil {
+			return fmt.Errorf("%w: %s", err, hookOutput(output.Bytes()))
+		}
+		code, err := cm.runtime.ExecExitCode(ctx, execID)
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return fmt.Errorf("exit code %d: %s", code, hookOutput(output.Bytes()))
+		}
+		return nil
+
+	case len(hook.Command) > 0:
+		cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+		cmd.Env = append(os.Environ(), event.Env()...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%w: %s", err, hookOutput(output))
+		}
+		return nil
+
+	default:
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+// hookOutput returns the end of the output for error messages
+func hookOutput(output []byte) string {
+	if len(output) > hookOutputLimit {
+		output = output[len(output)-hookOutputLimit:]
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// createdHooks runs the hooks of a new container and of a new workspace. The
+// container is removed if a fatal hook fails, so its hooks run again on the
+// next login.
+func (cm *ContainerManager) createdHooks(ctx context.Context, ws Workspace, ct *UserContainer, newWorkspace bool) error {
+	events := []string{HookContainerCreated}
+	if newWorkspace {
+		events = []string{HookWorkspaceCreated, HookContainerCreated}
+	}
+
+	for _, event := range events {
+		if err := cm.RunHooks(ctx, event, ws, ct.ID, ct.Image); err != nil {
+			if removeErr := cm.removeContainer(ctx, ws.Key()); removeErr != nil {
+				cm.log.WithError(removeErr).WithField("containerID", ct.ID).Error("Failed to remove container after failed hook")
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// imageCheckInterval is how long the resolved ID of an image is used before
+// the image is checked for updates again
+const imageCheckInterval = 5 * time.Minute
+
+// imageChecks keeps the ID every image reference resolved to at the last
+// check, so logins compare against it instead of pulling the image
+type imageChecks struct {
+	mutex  sync.Mutex
+	images map[string]*imageCheck // map of image reference to the last check
+}
+
+type imageCheck struct {
+	id         string
+	checked    time.Time
+	refreshing bool
+}
+
+func newImageChecks() *imageChecks {
+	return &imageChecks{images: make(map[string]*imageCheck)}
+}
+
+// latest returns the image ID of the last check, empty if the image was not
+// resolved yet. It reports true if the check is due, the caller has to refresh
+// the image and call refreshed. Other callers do not refresh it meanwhile.
+func (c *imageChecks) latest(ref string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	check, exists := c.images[ref]
+	if !exists {
+		check = &imageCheck{}
+		c.images[ref] = check
+	}
+	if check.refreshing || time.Since(check.checked) < imageCheckInterval {
+		return check.id, false
+	}
+	check.refreshing = true
+	return check.id, true
+}
+
+// record stores the ID the image reference resolved to
+func (c *imageChecks) record(ref, id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	check, exists := c.images[ref]
+	if !exists {
+		check = &imageCheck{}
+		c.images[ref] = check
+	}
+	check.id = id
+	check.checked = time.Now()
+}
+
+// refreshed ends the refresh of the image. A failed refresh keeps the last ID
+// and is retried after imageCheckInterval.
+func (c *imageChecks) refreshed(ref string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if check, exists := c.images[ref]; exists {
+		check.refreshing = false
+		check.checked = time.Now()
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"maps"
+	"os"
+	"path"
+	"regexp"
+)
+
+const (
+	managedLabel = "de.mc8051.sshcontainer"
+	// instanceLabel holds the INSTANCE_ID of the server that created a container,
+	// volume or network
+	instanceLabel = "de.mc8051.sshcontainer.instance"
+	// defaultInstance names the VFS directory of the server without an instance ID
+	defaultInstance = "default"
+)
+
+// instanceRegex has no dashes, so the instance ID in names like
+// sshcontainer_<instance>-<workspace> ends at the first dash
+var instanceRegex = regexp.MustCompile(`^[a-z0-9]{1,16}$`)
+
+// namePrefix is the prefix of container, volume and network names. Servers
+// without an instance ID keep the names of older releases. Usernames cannot
+// start with an underscore, so the names of an instance never collide with
+// those of users of the server without an ID.
+func namePrefix(instance string) string {
+	if instance == "" {
+		return "sshcontainer-"
+	}
+	return "sshcontainer_" + instance + "-"
+}
+
+// managedLabels returns the labels marking objects of this server instance
+// together with the extra labels
+func (cm *ContainerManager) managedLabels(extra map[string]string) map[string]string {
+	labels := map[string]string{managedLabel: "true"}
+	if cm.config.InstanceID != "" {
+		labels[instanceLabel] = cm.config.InstanceID
+	}
+	maps.Copy(labels, extra)
+	return labels
+}
+
+// ownedByInstance reports whether an object with the labels was created by this
+// server instance. Servers without an instance ID own the objects without one,
+// label filters cannot express that.
+func (cm *ContainerManager) ownedByInstance(labels map[string]string) bool {
+	return labels[instanceLabel] == cm.config.InstanceID
+}
+
+// instanceDir returns the directory of the workspace subvolumes of this
+// instance below vfsRoot. Usernames cannot start with an underscore, so it is
+// never taken for a workspace.
+func (cm *ContainerManager) instanceDir() string {
+	if cm.config.InstanceID == "" {
+		return "_" + defaultInstance
+	}
+	return "_" + cm.config.InstanceID
+}
+
+// vfsDir returns the directory of the workspace subvolumes of this instance
+func (cm *ContainerManager) vfsDir() string {
+	return path.Join(vfsRoot, cm.instanceDir())
+}
+
+// subvolumePath returns the path of the workspace subvolume below vfsRoot.
+// Servers without an instance ID keep using the subvolumes older releases
+// created in vfsRoot itself.
+func (cm *ContainerManager) subvolumePath(ws Workspace) string {
+	if cm.config.InstanceID == "" {
+		if _, err := os.Stat(path.Join(vfsRoot, ws.Key())); err == nil {
+			return ws.Key()
+		}
+	}
+	return path.Join(cm.instanceDir(), ws.Key())
+}
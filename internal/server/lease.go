@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// leaseRenewInterval is how often sessions renew their lease
+	leaseRenewInterval = 30 * time.Second
+	// leaseTTL is how long a lease lasts without renewal
+	leaseTTL = 3 * leaseRenewInterval
+)
+
+// Lease is held by a session while it uses a workspace container. Containers
+// with leases are not paused, stopped or removed. Leases expire if they are not
+// renewed, so a session that never releases its lease does not keep the
+// container forever.
+type Lease struct {
+	ID          string
+	ContainerID string
+	Workspace   Workspace
+
+	released chan struct{}
+	once     sync.Once
+}
+
+func newLeaseID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate lease ID: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// acquireLease adds a lease to the container. The caller must hold ct.mutex
+// unless the container is not tracked yet.
+func (ct *UserContainer) acquireLease(id string) *Lease {
+	now := time.Now()
+	if ct.leases == nil {
+		ct.leases = make(map[string]time.Time)
+	}
+	ct.leases[id] = now
+	ct.LastUsed = now
+	return &Lease{
+		ID:          id,
+		ContainerID: ct.ID,
+		Workspace:   Workspace{User: ct.User, Name: ct.Workspace},
+		released:    make(chan struct{}),
+	}
+}
+
+// activeLeases drops the expired leases of the container and returns the
+// number of the others. The caller must hold ct.mutex.
+func (cm *ContainerManager) activeLeases(ct *UserContainer) int {
+	maps.DeleteFunc(ct.leases, func(id string, renewed time.Time) bool {
+		if time.Since(renewed) <= leaseTTL {
+			return false
+		}
+		cm.log.WithFields(logrus.Fields{
+			"user":        ct.User,
+			"workspace":   ct.Workspace,
+			"containerID": ct.ID,
+			"lease":       id,
+		}).Warn("Lease expired without being released")
+		return true
+	})
+	return len(ct.leases)
+}
+
+// leasedContainer returns the container of the lease with ct.mutex locked, or
+// nil if the container was removed or replaced since
+func (cm *ContainerManager) leasedContainer(lease *Lease) *UserContainer {
+	cm.containersMutex.RLock()
+	defer cm.containersMutex.RUnlock()
+
+	ct, exists := cm.containers[lease.Workspace.Key()]
+	if !exists || ct.ID != lease.ContainerID {
+		return nil
+	}
+	ct.mutex.Lock()
+	return ct
+}
+
+// KeepAlive renews the lease until it is released or the context, usually
+// the one of the SSH connection, is done
+func (cm *ContainerManager) KeepAlive(ctx context.Context, lease *Lease) {
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ct := cm.leasedContainer(lease)
+			if ct == nil {
+				return
+			}
+			// an expired lease is not revived
+			if _, held := ct.leases[lease.ID]; held {
+				ct.leases[lease.ID] = time.Now()
+				ct.LastUsed = time.Now()
+			}
+			ct.mutex.Unlock()
+		case <-lease.released:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ReleaseContainer releases the lease of a session. Releasing a lease again
+// or after it expired does nothing.
+func (cm *ContainerManager) ReleaseContainer(lease *Lease) {
+	lease.once.Do(func() { close(lease.released) })
+
+	cm.log.WithFields(logrus.Fields{
+		"username":  lease.Workspace.User,
+		"workspace": lease.Workspace.Name,
+		"lease":     lease.ID,
+	}).Debug("Releasing container")
+
+	ct := cm.leasedContainer(lease)
+	if ct == nil {
+		return
+	}
+	defer ct.mutex.Unlock()
+	delete(ct.leases, lease.ID)
+	ct.LastUsed = time.Now()
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockRemovals makes removals wait until the returned function is called. The
+// channel receives the ID of every container whose removal starts.
+func blockRemovals(rt *fakeRuntime) (<-chan string, func()) {
+	started := make(chan string, 16)
+	gate := make(chan struct{})
+	rt.remove = func(ctx context.Context, id string) error {
+		started <- id
+		select {
+		case <-gate:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return started, func() { close(gate) }
+}
+
+// makeIdle moves the last use of the workspace container back by an hour
+func makeIdle(cm *ContainerManager, ws Workspace) *UserContainer {
+	cm.containersMutex.RLock()
+	ct := cm.containers[ws.Key()]
+	cm.containersMutex.RUnlock()
+
+	ct.mutex.Lock()
+	ct.LastUsed = time.Now().Add(-time.Hour)
+	ct.mutex.Unlock()
+	return ct
+}
+
+func TestLeasedContainerIsNotCleanedUp(t *testing.T) {
+	rt := newFakeRuntime(0)
+	cm := newTestManager(rt)
+	cm.config.ContainerIdleTimeout = 60
+	ws := Workspace{User: "alice", Name: DefaultWorkspace}
+
+	lease := login(t, cm, ws)
+	makeIdle(cm, ws)
+	cm.cleanupIdleContainers()
+	if !rt.exists(lease.ContainerID) {
+		t.Fatalf("leased container %s was removed", lease.ContainerID)
+	}
+
+	cm.ReleaseContainer(lease)
+	makeIdle(cm, ws)
+	cm.cleanupIdleContainers()
+	if rt.exists(lease.ContainerID) {
+		t.Errorf("released container %s was kept", lease.ContainerID)
+	}
+}
+
+func TestExpiredLeaseDoesNotKeepContainer(t *testing.T) {
+	rt := newFakeRuntime(0)
+	cm := newTestManager(rt)
+	cm.config.ContainerIdleTimeout = 60
+	ws := Workspace{User: "alice", Name: DefaultWorkspace}
+
+	lease := login(t, cm, ws)
+	ct := makeIdle(cm, ws)
+	ct.mutex.Lock()
+	ct.leases[lease.ID] = time.Now().Add(-2 * leaseTTL)
+	ct.mutex.Unlock()
+
+	cm.cleanupIdleContainers()
+	if rt.exists(lease.ContainerID) {
+		t.Errorf("container %s with an expired lease was kept", lease.ContainerID)
+	}
+	// releasing the lease of the removed container does nothing
+	cm.ReleaseContainer(lease)
+}
+
+// A container whose fatal hook failed and whose removal failed as well stays
+// tracked without a lease, so the idle cleanup removes it
+func TestFailedHookLeavesNoLease(t *testing.T) {
+	rt := newFakeRuntime(0)
+	cm := newTestManager(rt)
+	cm.config.ContainerIdleTimeout = 60
+	cm.hooks = []Hook{{Event: HookContainerCreated, Command: []string{"false"}, Fatal: true, timeout: time.Second}}
+	rt.remove = func(ctx context.Context, id string) error {
+		return errors.New("removal failed")
+	}
+	ws := Workspace{User: "alice", Name: DefaultWorkspace}
+
+	if _, _, err := cm.GetOrCreateContainer(context.Background(), ws, testEntry, Limits{}, nil); err == nil {
+		t.Fatal("login succeeded with a failing fatal hook")
+	}
+	ct := makeIdle(cm, ws)
+	ct.mutex.Lock()
+	leases := len(ct.leases)
+	ct.mutex.Unlock()
+	if leases != 0 {
+		t.Fatalf("container %s kept %d lease(s) after the failed login", ct.ID, leases)
+	}
+
+	rt.remove = nil
+	cm.cleanupIdleContainers()
+	if rt.exists(ct.ID) {
+		t.Errorf("container %s of the failed login was kept", ct.ID)
+	}
+}
+
+// A user reconnecting while the idle cleanup removes the container waits for
+// the removal and gets a new container, not the half removed one
+func TestReconnectDuringIdleRemoval(t *testing.T) {
+	rt := newFakeRuntime(0)
+	cm := newTestManager(rt)
+	cm.config.ContainerIdleTimeout = 60
+	ws := Workspace{User: "alice", Name: DefaultWorkspace}
+
+	old := login(t, cm, ws)
+	cm.ReleaseContainer(old)
+	makeIdle(cm, ws)
+
+	removing, release := blockRemovals(rt)
+	cleaned := make(chan struct{})
+	go func() {
+		defer close(cleaned)
+		cm.cleanupIdleContainers()
+	}()
+	if id := <-removing; id != old.ContainerID {
+		t.Fatalf("removing %s, want %s", id, old.ContainerID)
+	}
+
+	loggedIn := make(chan *Lease, 1)
+	go func() {
+		lease, _, err := cm.GetOrCreateContainer(context.Background(), ws, testEntry, Limits{}, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		loggedIn <- lease
+	}()
+
+	// the container is untracked while it is removed
+	waitFor(t, "ContainerStatus", func() {
+		if status := cm.ContainerStatus(ws); status != "not running" {
+			t.Errorf("status during removal = %q", status)
+		}
+	})
+	select {
+	case <-loggedIn:
+		t.Fatal("login did not wait for the removal")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	<-cleaned
+	lease := <-loggedIn
+	if lease == nil {
+		t.FailNow()
+	}
+	defer cm.ReleaseContainer(lease)
+	if lease.ContainerID == old.ContainerID {
+		t.Fatalf("login got the removed container %s", old.ContainerID)
+	}
+	if !rt.running(lease.ContainerID) {
+		t.Errorf("new container %s is not running", lease.ContainerID)
+	}
+	if rt.exists(old.ContainerID) {
+		t.Errorf("old container %s still exists", old.ContainerID)
+	}
+	if status := cm.ContainerStatus(ws); status != "running, 1 active session(s)" {
+		t.Errorf("status = %q", status)
+	}
+}
+
+// Sessions of several users log in and out while the idle cleanup removes
+// every idle container and reconcile runs. No session may get a container that
+// is removed while it holds the lease.
+func TestLeaseInterleavings(t *testing.T) {
+	rt := newFakeRuntime(time.Millisecond)
+	cm := newTestManager(rt)
+	// remove containers as soon as they are idle
+	cm.config.ContainerIdleTimeout = 0
+
+	stop := make(chan struct{})
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			cm.cleanupIdleContainers()
+			if err := cm.reconcile(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	var sessions sync.WaitGroup
+	for u := 0; u < 6; u++ {
+		ws := Workspace{User: fmt.Sprintf("user%d", u), Name: DefaultWorkspace}
+		for s := 0; s < 4; s++ {
+			sessions.Add(1)
+			go func() {
+				defer sessions.Done()
+				for i := 0; i < 15; i++ {
+					lease, _, err := cm.GetOrCreateContainer(context.Background(), ws, testEntry, Limits{}, nil)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if !rt.running(lease.ContainerID) {
+						t.Errorf("%s got container %s which is not running", ws.Key(), lease.ContainerID)
+					}
+					time.Sleep(time.Millisecond)
+					if !rt.exists(lease.ContainerID) {
+						t.Errorf("container %s of %s was removed while leased", lease.ContainerID, ws.Key())
+					}
+					cm.ReleaseContainer(lease)
+					cm.ReleaseContainer(lease)
+				}
+			}()
+		}
+	}
+	sessions.Wait()
+	close(stop)
+	background.Wait()
+
+	cm.cleanupIdleContainers()
+	if len(cm.containers) != 0 || len(cm.pending) != 0 {
+		t.Errorf("%d containers and %d pending workspaces left after the cleanup", len(cm.containers), len(cm.pending))
+	}
+	if containers, _ := rt.ListContainers(context.Background(), nil); len(containers) != 0 {
+		t.Errorf("%d containers left in the runtime", len(containers))
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import "sync"
+
+// keyedMutex hands out one mutex per key, e.g. per user, and forgets the
+// mutexes nobody holds or waits for
+type keyedMutex struct {
+	mutex sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int // holder and waiters
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*keyedLock)}
+}
+
+// Lock locks the mutex of the key and returns the function unlocking it
+func (k *keyedMutex) Lock(key string) func() {
+	k.mutex.Lock()
+	lock, exists := k.locks[key]
+	if !exists {
+		lock = &keyedLock{}
+		k.locks[key] = lock
+	}
+	lock.refs++
+	k.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		k.mutex.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mutex.Unlock()
+	}
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/ssh"
+	"github.com/muesli/termenv"
+)
+
+// loginMenuItem is a selectable entry of the login menu
+type loginMenuItem struct {
+	Title       string
+	Description string
+	Workspace   Workspace
+	Image       CatalogEntry
+}
+
+// loginMenuSection is a list of items of which the user picks exactly one
+type loginMenuSection struct {
+	Title  string
+	Items  []loginMenuItem
+	Cursor int
+}
+
+type loginMenuStyles struct {
+	title       lipgloss.Style
+	section     lipgloss.Style
+	active      lipgloss.Style
+	item        lipgloss.Style
+	selected    lipgloss.Style
+	description lipgloss.Style
+	info        lipgloss.Style
+	help        lipgloss.Style
+}
+
+type loginMenu struct {
+	user     string
+	sections []loginMenuSection
+	info     []string
+	focus    int
+	done     bool
+	width    int
+	styles   loginMenuStyles
+}
+
+func newLoginMenu(renderer *lipgloss.Renderer, user string, sections []loginMenuSection, info []string, width int) *loginMenu {
+	return &loginMenu{
+		user:     user,
+		sections: sections,
+		info:     info,
+		width:    width,
+		styles: loginMenuStyles{
+			title:       renderer.NewStyle().Bold(true).Foreground(lipgloss.Color("212")).MarginBottom(1),
+			section:     renderer.NewStyle().Foreground(lipgloss.Color("245")).Underline(true),
+			active:      renderer.NewStyle().Foreground(lipgloss.Color("212")).Underline(true),
+			item:        renderer.NewStyle().PaddingLeft(2),
+			selected:    renderer.NewStyle().PaddingLeft(1).Bold(true).Foreground(lipgloss.Color("212")),
+			description: renderer.NewStyle().PaddingLeft(4).Foreground(lipgloss.Color("245")),
+			info:        renderer.NewStyle().Border(lipgloss.RoundedBorder()).BorderForeground(lipgloss.Color("240")).Padding(0, 1).MarginTop(1),
+			help:        renderer.NewStyle().Foreground(lipgloss.Color("241")).MarginTop(1),
+		},
+	}
+}
+
+func (m *loginMenu) Init() tea.Cmd {
+	return nil
+}
+
+func (m *loginMenu) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+	case tea.KeyMsg:
+		section := &m.sections[m.focus]
+		switch msg.String() {
+		case "up", "k":
+			if section.Cursor > 0 {
+				section.Cursor--
+			}
+		case "down", "j":
+			if section.Cursor < len(section.Items)-1 {
+				section.Cursor++
+			}
+		case "tab", "right", "l":
+			m.focus = (m.focus + 1) % len(m.sections)
+		case "shift+tab", "left", "h":
+			m.focus = (m.focus + len(m.sections) - 1) % len(m.sections)
+		case "enter":
+			m.done = true
+			return m, tea.Quit
+		case "q", "esc", "ctrl+c", "ctrl+d":
+			return m, tea.Quit
+		}
+	}
+	return m, nil
+}
+
+func (m *loginMenu) View() string {
+	var b strings.Builder
+
+	b.WriteString(m.styles.title.Render(fmt.Sprintf("Welcome %s, choose your environment", m.user)))
+	b.WriteString("\n")
+
+	for s, section := range m.sections {
+		if s == m.focus {
+			b.WriteString(m.styles.active.Render(section.Title))
+		} else {
+			b.WriteString(m.styles.section.Render(section.Title))
+		}
+		b.WriteString("\n")
+
+		for i, item := range section.Items {
+			if i == section.Cursor {
+				b.WriteString(m.styles.selected.Render("> " + item.Title))
+			} else {
+				b.WriteString(m.styles.item.Render(item.Title))
+			}
+			b.WriteString("\n")
+			if item.Description != "" {
+				b.WriteString(m.styles.description.Render(item.Description))
+				b.WriteString("\n")
+			}
+		}
+		b.WriteString("\n")
+	}
+
+	if len(m.info) > 0 {
+		info := m.styles.info
+		if m.width > 4 {
+			info = info.MaxWidth(m.width)
+		}
+		b.WriteString(info.Render(strings.Join(m.info, "\n")))
+		b.WriteString("\n")
+	}
+
+	b.WriteString(m.styles.help.Render("↑/↓ select • tab switch list • enter connect • q quit"))
+	b.WriteString("\n")
+	return b.String()
+}
+
+// runLoginMenu shows the login menu on the session and returns the index of
+// the chosen item per section, or nil if the user quit.
+func runLoginMenu(sess ssh.Session, user string, input *sessionInput, window *windowWatcher, sections []loginMenuSection, info []string) ([]int, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	renderer := lipgloss.NewRenderer(sess)
+	renderer.SetColorProfile(termenv.ANSI256)
+
+	menu := newLoginMenu(renderer, user, sections, info, 0)
+	p := tea.NewProgram(
+		menu,
+		tea.WithInput(input.Reader(done)),
+		tea.WithOutput(sess),
+		tea.WithAltScreen(),
+		tea.WithoutSignalHandler(),
+	)
+
+	// window changes are forwarded to the menu while it owns the terminal
+	win := window.Notify(func(win ssh.Window) {
+		p.Send(tea.WindowSizeMsg{Width: win.Width, Height: win.Height})
+	})
+	defer window.Notify(nil)
+	menu.width = win.Width
+
+	if _, err := p.Run(); err != nil {
+		return nil, fmt.Errorf("failed to run login menu: %w", err)
+	}
+	if !menu.done {
+		return nil, nil
+	}
+
+	choice := make([]int, len(menu.sections))
+	for i, section := range menu.sections {
+		choice[i] = section.Cursor
+	}
+	return choice, nil
+}
+
+// loginMenuWorkspaces lists the workspaces the user can choose from. The
+// requested workspace is listed first, even if it does not exist yet.
+func (s *Server) loginMenuWorkspaces(requested Workspace) loginMenuSection {
+	workspaces := []Workspace{requested}
+
+	existing, err := s.containers.ListWorkspaces(context.Background(), requested.User)
+	if err != nil {
+		s.log.WithError(err).WithField("user", requested.User).Debug("Failed to list workspaces")
+	}
+	for _, ws := range existing {
+		if ws.Key() != requested.Key() {
+			workspaces = append(workspaces, ws)
+		}
+	}
+
+	section := loginMenuSection{Title: "Workspace"}
+	for _, ws := range workspaces {
+		details := []string{s.containers.ContainerStatus(ws)}
+
+		used, limit, err := s.containers.QuotaUsage(ws)
+		if errors.Is(err, ErrUsageUnavailable) {
+			details = append(details, fmt.Sprintf("%s quota", FormatSize(limit)))
+		} else if err != nil {
+			details = append(details, "new workspace")
+		} else if limit > 0 {
+			details = append(details, fmt.Sprintf("%s of %s used", FormatSize(used), FormatSize(limit)))
+		} else {
+			details = append(details, fmt.Sprintf("%s used", FormatSize(used)))
+		}
+
+		section.Items = append(section.Items, loginMenuItem{
+			Title:       ws.Name,
+			Description: strings.Join(details, " · "),
+			Workspace:   ws,
+		})
+	}
+	return section
+}
+
+// loginMenuImages lists the catalog entries available to the user's groups
+func (s *Server) loginMenuImages(groups []string, selected CatalogEntry) loginMenuSection {
+	section := loginMenuSection{Title: "Image"}
+	for i, entry := range s.catalog.Allowed(groups) {
+		if entry.Name == selected.Name {
+			section.Cursor = i
+		}
+		section.Items = append(section.Items, loginMenuItem{
+			Title:       entry.Name,
+			Description: entry.Image,
+			Image:       entry,
+		})
+	}
+	return section
+}
+
+// loginMenuInfo returns the recent sessions of the user
+func (s *Server) loginMenuInfo(username string) []string {
+	info := make([]string, 0)
+
+	recent := s.history.Recent(username)
+	if len(recent) > 0 {
+		info = append(info, "Recent sessions:")
+	}
+	for _, record := range recent {
+		state := "active"
+		if !record.Ended.IsZero() {
+			state = record.Ended.Sub(record.Started).Round(time.Second).String()
+		}
+		info = append(info, fmt.Sprintf("  %s %s from %s (%s)", record.Started.Format(time.DateTime), record.Workspace.Name, record.Remote, state))
+	}
+
+	return info
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// isolatedNetwork returns the internal network of the container or "" if
+// network isolation is off. Users share a network per user or per resource
+// profile, the profile being how policy rules group users.
+func (cm *ContainerManager) isolatedNetwork(cfg ContainerConfig) (string, error) {
+	switch cm.config.NetworkIsolation {
+	case "user":
+		return namePrefix(cm.config.InstanceID) + "net-" + cfg.User, nil
+	case "group":
+		profile := cfg.Limits.Profile
+		if profile == "" {
+			profile = DefaultProfile
+		}
+		if !usernameRegex.MatchString(profile) {
+			return "", fmt.Errorf("profile name %q cannot be used as network name", profile)
+		}
+		return namePrefix(cm.config.InstanceID) + "net-profile-" + profile, nil
+	}
+	return "", nil
+}
+
+// ensureNetwork creates the internal network and connects the gateways to it.
+// The gateways are the only way out of the network.
+func (cm *ContainerManager) ensureNetwork(ctx context.Context, name string) error {
+	created, err := cm.runtime.CreateNetwork(ctx, NetworkSpec{
+		Name:     name,
+		Internal: true,
+		Labels:   cm.managedLabels(nil),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create network %s: %w", name, err)
+	}
+	if !created {
+		return nil
+	}
+
+	cm.log.WithField("network", name).Info("Created isolated network")
+	for _, gateway := range cm.config.NetworkGateways {
+		container, alias, _ := strings.Cut(gateway, ":")
+		var aliases []string
+		if alias != "" {
+			aliases = []string{alias}
+		}
+
+		if err := cm.runtime.ConnectNetwork(ctx, name, container, aliases); err != nil {
+			cm.removeNetwork(ctx, name)
+			return fmt.Errorf("failed to connect gateway %s to network %s: %w", container, name, err)
+		}
+	}
+	return nil
+}
+
+// releaseNetwork removes the network once no tracked or pending container uses
+// it anymore. The caller must hold containersMutex.
+func (cm *ContainerManager) releaseNetwork(ctx context.Context, name string) {
+	for _, ct := range cm.containers {
+		if ct.Network == name {
+			return
+		}
+	}
+	for _, network := range cm.pending {
+		if network == name {
+			return
+		}
+	}
+	cm.removeNetwork(ctx, name)
+}
+
+// removeNetwork disconnects the gateways and removes the network
+func (cm *ContainerManager) removeNetwork(ctx context.Context, name string) {
+	for _, gateway := range cm.config.NetworkGateways {
+		container, _, _ := strings.Cut(gateway, ":")
+		if err := cm.runtime.DisconnectNetwork(ctx, name, container); err != nil {
+			cm.log.WithError(err).WithFields(logrus.Fields{
+				"network": name,
+				"gateway": container,
+			}).Warn("Failed to disconnect gateway")
+		}
+	}
+
+	if err := cm.runtime.RemoveNetwork(ctx, name); err != nil {
+		cm.log.WithError(err).WithField("network", name).Error("Failed to remove network")
+		return
+	}
+	cm.log.WithField("network", name).Info("Removed isolated network")
+}
+
+// updateAddresses stores the IP addresses of the container, which identify it
+// to the DNS filter. The caller must not hold ct.mutex.
+func (cm *ContainerManager) updateAddresses(ctx context.Context, ct *UserContainer) {
+	info, err := cm.runtime.InspectContainer(ctx, ct.ID)
+	if err != nil {
+		cm.log.WithError(err).WithField("containerID", ct.ID).Warn("Failed to get container addresses")
+		return
+	}
+
+	addresses := make([]string, 0, len(info.Network))
+	for _, ip := range info.Network {
+		if ip != "" {
+			addresses = append(addresses, ip)
+		}
+	}
+	ct.mutex.Lock()
+	ct.Addresses = addresses
+	ct.mutex.Unlock()
+}
+
+// resolverAddress returns the address of the DNS filter for the container,
+// which is the IP of the server in the network the container is created in
+func (cm *ContainerManager) resolverAddress(ctx context.Context, spec ContainerSpec) (string, error) {
+	if cm.config.DNSFilterAddress != "" {
+		return cm.config.DNSFilterAddress, nil
+	}
+
+	networkName := spec.NetworkMode
+	if len(spec.Networks) > 0 {
+		networkName = spec.Networks[0]
+	}
+
+	info, err := cm.runtime.InspectContainer(ctx, cm.serverID)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect server container: %w", err)
+	}
+	ip := info.Network[networkName]
+	if ip == "" {
+		return "", fmt.Errorf("server is not connected to network %s, add it to NETWORK_GATEWAYS or set DNS_FILTER_ADDRESS", networkName)
+	}
+	return ip, nil
+}
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DefaultProfile is used for users without a matching policy rule
+const DefaultProfile = "default"
+
+// ResourceProfile sets the resources of user containers. Empty fields keep the global config.
+type ResourceProfile struct {
+	Memory      string   `json:"memory"`
+	MemorySwap  string   `json:"memorySwap"`
+	CPU         float64  `json:"cpu"`
+	PidsLimit   int64    `json:"pidsLimit"`
+	Ulimits     []string `json:"ulimits"`
+	BlkioWeight uint16   `json:"blkioWeight"`
+	TmpfsSize   string   `json:"tmpfsSize"`
+	Quota       string   `json:"quota"`
+	Devices     []string `json:"devices"`
+	CapAdd      []string `json:"capAdd"`
+	Egress      *Egress  `json:"egress"`
+	// SecurityProfile is the seccomp and AppArmor profile, see LookupSecurityProfile
+	SecurityProfile string `json:"securityProfile"`
+}
+
+// Egress are the domains users may reach through the egress proxy. A domain
+// matches itself and its subdomains. Denied domains win over allowed ones, an
+// empty allowlist allows every domain that is not denied.
+type Egress struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// Allows reports whether the host may be reached
+func (e Egress) Allows(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if matchesDomain(host, e.Deny) {
+		return false
+	}
+	return len(e.Allow) == 0 || matchesDomain(host, e.Allow)
+}
+
+func matchesDomain(host string, domains []string) bool {
+	for _, domain := range domains {
+		domain = strings.TrimPrefix(strings.ToLower(domain), "*.")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyRule assigns a profile to users and members of groups
+type PolicyRule struct {
+	Users   []string `json:"users"`
+	Groups  []string `json:"groups"`
+	Profile string   `json:"profile"`
+}
+
+// Matches reports whether the rule applies to the user
+func (r PolicyRule) Matches(user string, groups []string) bool {
+	if slices.Contains(r.Users, user) {
+		return true
+	}
+	for _, group := range groups {
+		if slices.Contains(r.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// Limits are the parsed resources applied to a user container
+type Limits struct {
+	Profile    string
+	Resources  Resources
+	TmpfsBytes int64
+	QuotaBytes int64
+	Devices    []string
+	CapAdd     []string
+	Egress     Egress
+	// SecurityProfile applies to images without a security profile of their own
+	SecurityProfile string
+}
+
+// Policy maps users and groups to resource profiles. The first matching rule wins.
+type Policy struct {
+	Profiles map[string]ResourceProfile `json:"profiles"`
+	Rules    []PolicyRule               `json:"rules"`
+
+	limits map[string]Limits
+}
+
+// LoadPolicy reads the policy file. Without a file every user gets the global config.
+func LoadPolicy(config *Config) (*Policy, error) {
+	defaults := Limits{
+		Profile:    DefaultProfile,
+		Resources:  config.resources,
+		TmpfsBytes: config.quotaBytes,
+		QuotaBytes: config.quotaBytes,
+		Devices:    config.DockerDevices,
+		CapAdd:     config.DockerCapAdd,
+
+		SecurityProfile: config.SecurityProfile,
+	}
+
+	policy := &Policy{}
+	if config.PolicyFile != "" {
+		data, err := os.ReadFile(config.PolicyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read policy file: %w", err)
+		}
+		if err := json.Unmarshal(data, policy); err != nil {
+			return nil, fmt.Errorf("failed to parse policy file: %w", err)
+		}
+	}
+
+	policy.limits = map[string]Limits{DefaultProfile: defaults}
+	if profile, exists := policy.Profiles[DefaultProfile]; exists {
+		limits, err := profile.apply(DefaultProfile, defaults)
+		if err != nil {
+			return nil, err
+		}
+		policy.limits[DefaultProfile] = limits
+	}
+
+	// other profiles build on the default profile
+	for name, profile := range policy.Profiles {
+		if name == DefaultProfile {
+			continue
+		}
+		limits, err := profile.apply(name, policy.limits[DefaultProfile])
+		if err != nil {
+			return nil, err
+		}
+		policy.limits[name] = limits
+	}
+
+	for i, rule := range policy.Rules {
+		if _, exists := policy.limits[rule.Profile]; !exists {
+			return nil, fmt.Errorf("policy rule %d uses unknown profile %q", i, rule.Profile)
+		}
+	}
+
+	return policy, nil
+}
+
+// Resolve returns the limits of the first rule matching the user
+func (p *Policy) Resolve(user string, groups []string) Limits {
+	for _, rule := range p.Rules {
+		if rule.Matches(user, groups) {
+			return p.limits[rule.Profile]
+		}
+	}
+	return p.Default()
+}
+
+// Default returns the limits of users without a matching rule
+func (p *Policy) Default() Limits {
+	return p.limits[DefaultProfile]
+}
+
+// apply overrides the base limits with the fields set in the profile
+func (rp ResourceProfile) apply(name string, base Limits) (Limits, error) {
+	limits := base
+	limits.Profile = name
+	limits.Resources.Ulimits = slices.Clone(base.Resources.Ulimits)
+
+	if rp.Memory != "" {
+		size, err := ParseSize(rp.Memory)
+		if err != nil {
+			return limits, fmt.Errorf("profile %s: invalid memory: %w", name, err)
+		}
+		limits.Resources.MemoryBytes = int64(size)
+	}
+	if rp.MemorySwap != "" {
+		swap, err := parseMemorySwap(rp.MemorySwap)
+		if err != nil {
+			return limits, fmt.Errorf("profile %s: %w", name, err)
+		}
+		limits.Resources.MemorySwapBytes = swap
+	}
+	if rp.CPU < 0 {
+		return limits, fmt.Errorf("profile %s: invalid cpu: %v", name, rp.CPU)
+	} else if rp.CPU > 0 {
+		limits.Resources.NanoCPUs = int64(rp.CPU * 1000000000)
+	}
+	if rp.PidsLimit < 0 {
+		return limits, fmt.Errorf("profile %s: invalid pids limit: %d", name, rp.PidsLimit)
+	} else if rp.PidsLimit > 0 {
+		limits.Resources.PidsLimit = rp.PidsLimit
+	}
+	if len(rp.Ulimits) > 0 {
+		ulimits, err := ParseUlimits(rp.Ulimits)
+		if err != nil {
+			return limits, fmt.Errorf("profile %s: %w", name, err)
+		}
+		limits.Resources.Ulimits = mergeUlimits(limits.Resources.Ulimits, ulimits)
+	}
+	if rp.BlkioWeight != 0 {
+		if rp.BlkioWeight < 10 || rp.BlkioWeight > 1000 {
+			return limits, fmt.Errorf("profile %s: blkio weight must be between 10 and 1000", name)
+		}
+		limits.Resources.BlkioWeight = rp.BlkioWeight
+	}
+	if rp.TmpfsSize != "" {
+		size, err := ParseSize(rp.TmpfsSize)
+		if err != nil {
+			return limits, fmt.Errorf("profile %s: invalid tmpfs size: %w", name, err)
+		}
+		limits.TmpfsBytes = int64(size)
+	}
+	if rp.Quota != "" {
+		size, err := ParseSize(rp.Quota)
+		if err != nil {
+			return limits, fmt.Errorf("profile %s: invalid quota: %w", name, err)
+		}
+		limits.QuotaBytes = int64(size)
+	}
+	if rp.Devices != nil {
+		limits.Devices = rp.Devices
+	}
+	if rp.CapAdd != nil {
+		limits.CapAdd = rp.CapAdd
+	}
+	if rp.Egress != nil {
+		limits.Egress = *rp.Egress
+	}
+	if rp.SecurityProfile != "" {
+		if _, err := LookupSecurityProfile(rp.SecurityProfile); err != nil {
+			return limits, fmt.Errorf("profile %s: %w", name, err)
+		}
+		limits.SecurityProfile = rp.SecurityProfile
+	}
+
+	if limits.Resources.MemorySwapBytes > 0 && limits.Resources.MemorySwapBytes < limits.Resources.MemoryBytes {
+		return limits, fmt.Errorf("profile %s: memory swap must not be lower than memory", name)
+	}
+	return limits, nil
+}
+
+// parseMemorySwap parses the memory plus swap limit, -1 allows unlimited swap
+func parseMemorySwap(value string) (int64, error) {
+	if value == "-1" {
+		return -1, nil
+	}
+	size, err := ParseSize(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory swap: %w", err)
+	}
+	return int64(size), nil
+}
+
+// ParseUlimits parses ulimits like "nofile=1024:4096" or "core=0"
+func ParseUlimits(values []string) ([]Ulimit, error) {
+	ulimits := make([]Ulimit, 0, len(values))
+	for _, value := range values {
+		name, limit, ok := strings.Cut(value, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid ulimit: %q", value)
+		}
+
+		softValue, hardValue, hasHard := strings.Cut(limit, ":")
+		if !hasHard {
+			hardValue = softValue
+		}
+		soft, err := strconv.ParseInt(softValue, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid soft limit in ulimit %q", value)
+		}
+		hard, err := strconv.ParseInt(hardValue, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hard limit in ulimit %q", value)
+		}
+		if soft > hard {
+			return nil, fmt.Errorf("soft limit exceeds hard limit in ulimit %q", value)
+		}
+
+		ulimits = append(ulimits, Ulimit{Name: name, Soft: soft, Hard: hard})
+	}
+	return ulimits, nil
+}
+
+// mergeUlimits replaces ulimits of the base with the same name
+func mergeUlimits(base, overrides []Ulimit) []Ulimit {
+	merged := slices.DeleteFunc(base, func(u Ulimit) bool {
+		return slices.ContainsFunc(overrides, func(o Ulimit) bool { return o.Name == u.Name })
+	})
+	return append(merged, overrides...)
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// poolRoot holds one directory per pool slot. It is the server side of
+	// POOL_SLOT_HOST_PATH and has to be mounted with rshared propagation.
+	poolRoot         = "/mnt/pool"
+	poolLabel        = "de.mc8051.sshcontainer.pool"
+	poolFillInterval = 10 * time.Second
+)
+
+// pooledContainer is a started container that is not assigned to a workspace yet
+type pooledContainer struct {
+	ID    string
+	Slot  string
+	Entry CatalogEntry
+}
+
+// ContainerPool keeps started, unassigned containers per catalog entry so logins
+// do not wait for the image pull and container start. Every pooled container
+// bind mounts an empty slot directory as workspace with rslave propagation. On
+// claim, the workspace subvolume is bind mounted onto the slot and shows up in
+// the running container.
+type ContainerPool struct {
+	cm       *ContainerManager
+	hostPath string
+	idle     map[string][]*pooledContainer // map of catalog entry name to idle containers
+	pending  map[string]bool               // slots of containers being created or claimed
+	owners   map[string]Workspace          // map of slot to the workspace of claimed containers
+	mutex    sync.Mutex
+	refill   chan struct{}
+}
+
+func newContainerPool(cm *ContainerManager, hostPath string) *ContainerPool {
+	return &ContainerPool{
+		cm:       cm,
+		hostPath: hostPath,
+		idle:     make(map[string][]*pooledContainer),
+		pending:  make(map[string]bool),
+		owners:   make(map[string]Workspace),
+		refill:   make(chan struct{}, 1),
+	}
+}
+
+func (p *ContainerPool) run(shutdown <-chan struct{}) {
+	ticker := time.NewTicker(poolFillInterval)
+	defer ticker.Stop()
+
+	for {
+		p.fill(context.Background())
+
+		select {
+		case <-ticker.C:
+		case <-p.refill:
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// fill brings the number of idle containers of every entry to the size for the current time
+func (p *ContainerPool) fill(ctx context.Context) {
+	now := time.Now()
+	for _, entry := range p.cm.catalog.Entries {
+		target := entry.Pool.SizeAt(now)
+
+		p.mutex.Lock()
+		idle := len(p.idle[entry.Name])
+		var surplus []*pooledContainer
+		if idle > target {
+			surplus = p.idle[entry.Name][target:]
+			p.idle[entry.Name] = p.idle[entry.Name][:target]
+		}
+		p.mutex.Unlock()
+
+		for _, pc := range surplus {
+			p.remove(ctx, pc)
+		}
+
+		for i := idle; i < target; i++ {
+			pc, err := p.create(ctx, entry)
+			if err != nil {
+				p.cm.log.WithError(err).WithField("image", entry.Name).Error("Failed to create pooled container")
+				break
+			}
+
+			p.mutex.Lock()
+			p.idle[entry.Name] = append(p.idle[entry.Name], pc)
+			delete(p.pending, pc.Slot)
+			p.mutex.Unlock()
+		}
+	}
+}
+
+func (p *ContainerPool) create(ctx context.Context, entry CatalogEntry) (*pooledContainer, error) {
+	entry, err := p.cm.prepareImage(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, fmt.Errorf("failed to generate pool slot: %w", err)
+	}
+	slot := hex.EncodeToString(buf)
+
+	p.mutex.Lock()
+	p.pending[slot] = true
+	p.mutex.Unlock()
+
+	if err := os.MkdirAll(path.Join(poolRoot, slot), 0755); err != nil {
+		p.release(slot)
+		return nil, fmt.Errorf("failed to create pool slot: %w", err)
+	}
+
+	slotMount := Mount{
+		Type:        MountBind,
+		Source:      path.Join(p.hostPath, slot),
+		Target:      entry.MountPath,
+		Propagation: "rslave",
+	}
+	limits := p.cm.policy.Default()
+	spec, err := p.cm.containerSpec(namePrefix(p.cm.config.InstanceID)+"pool-"+slot, entry, slotMount, limits, p.cm.managedLabels(map[string]string{
+		"de.mc8051.sshcontainer.image":   entry.Name,
+		"de.mc8051.sshcontainer.imageid": entry.ImageID,
+		"de.mc8051.sshcontainer.profile": limits.Profile,
+		poolLabel:                        slot,
+	}))
+	if err != nil {
+		p.release(slot)
+		return nil, err
+	}
+
+	containerID, err := p.cm.createFromSpec(ctx, spec, logrus.Fields{"slot": slot})
+	if err != nil {
+		p.release(slot)
+		return nil, err
+	}
+
+	pc := &pooledContainer{ID: containerID, Slot: slot, Entry: entry}
+	if err := p.cm.runtime.StartContainer(ctx, containerID); err != nil {
+		p.remove(ctx, pc)
+		return nil, fmt.Errorf("failed to start pooled container: %w", err)
+	}
+	return pc, nil
+}
+
+// Claim assigns an idle container of the entry to the workspace. It returns
+// false if none is available or it could not be prepared for the workspace.
+func (p *ContainerPool) Claim(ctx context.Context, ws Workspace, entry CatalogEntry, limits Limits) (*pooledContainer, bool) {
+	p.mutex.Lock()
+	idle := p.idle[entry.Name]
+	if len(idle) == 0 {
+		p.mutex.Unlock()
+		return nil, false
+	}
+	pc := idle[0]
+	p.idle[entry.Name] = idle[1:]
+	// the slot stays pending until the container is tracked, see claimed
+	p.pending[pc.Slot] = true
+	p.mutex.Unlock()
+
+	// refill in the background
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+
+	fields := logrus.Fields{
+		"user":        ws.User,
+		"workspace":   ws.Name,
+		"containerID": pc.ID,
+		"slot":        pc.Slot,
+	}
+
+	if err := p.assign(ctx, ws, pc, limits); err != nil {
+		p.cm.log.WithFields(fields).WithError(err).Error("Failed to claim pooled container")
+		p.remove(ctx, pc)
+		return nil, false
+	}
+
+	p.mutex.Lock()
+	p.owners[pc.Slot] = ws
+	p.mutex.Unlock()
+
+	p.cm.log.WithFields(fields).Info("Claimed pooled container")
+	return pc, true
+}
+
+// ownerEnv returns the environment that names the owner of a claimed container.
+// Labels cannot be changed after the container is created, so a claimed
+// container keeps its pool labels and gets the owner with every exec instead.
+func ownerEnv(ctx context.Context, ws Workspace) []string {
+	event := HookEvent{User: ws.User, Workspace: ws.Name}
+	if session, ok := ctx.Value(sessionContextKey).(hookSession); ok {
+		event.Claims = session.Claims
+	}
+	claims, _ := json.Marshal(event.Claims)
+	return []string{
+		"SSHCONTAINER_USER=" + event.User,
+		"SSHCONTAINER_WORKSPACE=" + event.Workspace,
+		"SSHCONTAINER_CLAIMS=" + string(claims),
+	}
+}
+
+// assign mounts the workspace subvolume into the slot and names the container after the workspace
+func (p *ContainerPool) assign(ctx context.Context, ws Workspace, pc *pooledContainer, limits Limits) error {
+	userVFS, err := p.cm.createSubvolume(ContainerConfig{User: ws.User, Workspace: ws, Entry: pc.Entry, Limits: limits})
+	if err != nil {
+		return err
+	}
+
+	if out, err := exec.Command("mount", "--bind", userVFS, path.Join(poolRoot, pc.Slot)).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to mount workspace into slot: %w: %s", err, out)
+	}
+
+	if err := p.cm.runtime.RenameContainer(ctx, pc.ID, ws.ContainerName(p.cm.config.InstanceID)); err != nil {
+		return fmt.Errorf("failed to rename container: %w", err)
+	}
+	return nil
+}
+
+// claimed is called once the claimed container is tracked by the manager
+func (p *ContainerPool) claimed(slot string) {
+	p.mutex.Lock()
+	delete(p.pending, slot)
+	p.mutex.Unlock()
+}
+
+// Owner returns the workspace the container of the slot was claimed for
+func (p *ContainerPool) Owner(slot string) (Workspace, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	ws, claimed := p.owners[slot]
+	return ws, claimed
+}
+
+// Owns reports whether the slot belongs to an idle container or one being created
+func (p *ContainerPool) Owns(slot string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.pending[slot] {
+		return true
+	}
+	for _, idle := range p.idle {
+		for _, pc := range idle {
+			if pc.Slot == slot {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *ContainerPool) remove(ctx context.Context, pc *pooledContainer) {
+	if err := p.cm.runtime.RemoveContainer(ctx, pc.ID); err != nil {
+		p.cm.log.WithError(err).WithField("containerID", pc.ID).Error("Failed to remove pooled container")
+	}
+	p.release(pc.Slot)
+}
+
+// release unmounts the workspace from the slot and deletes the slot directory
+func (p *ContainerPool) release(slot string) {
+	p.mutex.Lock()
+	delete(p.pending, slot)
+	delete(p.owners, slot)
+	p.mutex.Unlock()
+
+	slotPath := path.Join(poolRoot, slot)
+	// the slot is only mounted if the container was claimed
+	_ = exec.Command("umount", slotPath).Run()
+	if err := os.Remove(slotPath); err != nil && !os.IsNotExist(err) {
+		p.cm.log.WithError(err).WithField("slot", slot).Error("Failed to remove pool slot")
+	}
+}
+
+// Shutdown removes all idle containers
+func (p *ContainerPool) Shutdown(ctx context.Context) {
+	p.mutex.Lock()
+	idle := p.idle
+	p.idle = make(map[string][]*pooledContainer)
+	p.mutex.Unlock()
+
+	for _, containers := range idle {
+		for _, pc := range containers {
+			p.remove(ctx, pc)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const proxyDialTimeout = 10 * time.Second
+
+// hopHeaders are removed before a request is forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// EgressProxy is a forward proxy for HTTP and HTTPS (CONNECT) requests of user
+// containers. Every workspace authenticates with its key and a token derived
+// from the proxy secret, so requests are logged with the user and checked
+// against the egress rules of the user's resource profile.
+type EgressProxy struct {
+	containers   *ContainerManager
+	secret       []byte
+	url          *url.URL
+	allowPrivate bool
+	dialer       *net.Dialer
+	transport    *http.Transport
+	log          *logrus.Logger
+}
+
+func NewEgressProxy(config *Config, containers *ContainerManager, log *logrus.Logger) (*EgressProxy, error) {
+	proxyURL, err := url.Parse(config.EgressProxyURL)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid egress proxy url: %q", config.EgressProxyURL)
+	}
+
+	secret := []byte(config.EgressProxySecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to generate egress proxy secret: %w", err)
+		}
+	}
+
+	p := &EgressProxy{
+		containers:   containers,
+		secret:       secret,
+		url:          proxyURL,
+		allowPrivate: config.EgressProxyAllowPrivate,
+		log:          log,
+	}
+	p.dialer = &net.Dialer{
+		Timeout: proxyDialTimeout,
+		Control: p.checkAddress,
+	}
+	p.transport = &http.Transport{
+		DialContext:         p.dialer.DialContext,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return p, nil
+}
+
+// ListenAndServe runs the proxy on the address
+func (p *EgressProxy) ListenAndServe(addr string) error {
+	p.log.WithField("addr", addr).Info("Starting egress proxy")
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           p,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	return server.ListenAndServe()
+}
+
+// token returns the proxy password of the workspace
+func (p *EgressProxy) token(key string) string {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Env returns the proxy variables for sessions of the workspace
+func (p *EgressProxy) Env(ws Workspace) []string {
+	proxyURL := *p.url
+	proxyURL.User = url.UserPassword(ws.Key(), p.token(ws.Key()))
+	value := proxyURL.String()
+
+	env := make([]string, 0, 6)
+	for _, name := range []string{"http_proxy", "https_proxy", "HTTP_PROXY", "HTTPS_PROXY"} {
+		env = append(env, name+"="+value)
+	}
+	noProxy := "localhost,127.0.0.1," + p.url.Hostname()
+	return append(env, "no_proxy="+noProxy, "NO_PROXY="+noProxy)
+}
+
+// authenticate returns the workspace key of the request
+func (p *EgressProxy) authenticate(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Proxy-Authorization")
+	encoded, found := strings.CutPrefix(auth, "Basic ")
+	if !found {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	key, token, _ := strings.Cut(string(decoded), ":")
+	if !hmac.Equal([]byte(token), []byte(p.token(key))) {
+		return "", false
+	}
+	return key, true
+}
+
+// checkAddress refuses connections to private addresses after DNS resolution,
+// so users cannot reach internal services through the proxy
+func (p *EgressProxy) checkAddress(network, address string, _ syscall.RawConn) error {
+	if p.allowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return fmt.Errorf("connections to %s are not allowed", host)
+	}
+	return nil
+}
+
+func (p *EgressProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fields := logrus.Fields{
+		"remote": r.RemoteAddr,
+		"method": r.Method,
+		"host":   r.Host,
+	}
+
+	key, ok := p.authenticate(r)
+	if !ok {
+		p.log.WithFields(fields).Warn("Rejected unauthenticated proxy request")
+		w.Header().Set("Proxy-Authenticate", `Basic realm="sshcontainer"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	user, workspace, _ := strings.Cut(key, workspaceSeparator)
+	if workspace == "" {
+		workspace = DefaultWorkspace
+	}
+	fields["user"] = user
+	fields["workspace"] = workspace
+
+	egress, ok := p.containers.egressRules(key)
+	if !ok {
+		p.log.WithFields(fields).Warn("Rejected proxy request of workspace without container")
+		http.Error(w, "workspace has no container", http.StatusForbidden)
+		return
+	}
+
+	host := r.Host
+	if r.Method != http.MethodConnect && r.URL.Host != "" {
+		host = r.URL.Host
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	if !egress.Allows(hostname) {
+		p.log.WithFields(fields).Warn("Denied proxy request")
+		http.Error(w, fmt.Sprintf("access to %s is not allowed", hostname), http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r, host, fields)
+		return
+	}
+	p.forward(w, r, fields)
+}
+
+// forward sends a plain HTTP request to the target and copies the response back
+func (p *EgressProxy) forward(w http.ResponseWriter, r *http.Request, fields logrus.Fields) {
+	if r.URL.Scheme != "http" || r.URL.Host == "" {
+		http.Error(w, "only absolute http URLs are supported", http.StatusBadRequest)
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	for _, header := range hopHeaders {
+		out.Header.Del(header)
+	}
+
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		p.log.WithFields(fields).WithError(err).Warn("Proxy request failed")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, header := range hopHeaders {
+		resp.Header.Del(header)
+	}
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	written, _ := io.Copy(w, resp.Body)
+
+	fields["status"] = resp.StatusCode
+	fields["bytes"] = written
+	p.log.WithFields(fields).Info("Proxied request")
+}
+
+// tunnel connects the client to the target for CONNECT requests
+func (p *EgressProxy) tunnel(w http.ResponseWriter, r *http.Request, host string, fields logrus.Fields) {
+	ctx, cancel := context.WithTimeout(r.Context(), proxyDialTimeout)
+	target, err := p.dialer.DialContext(ctx, "tcp", host)
+	cancel()
+	if err != nil {
+		p.log.WithFields(fields).WithError(err).Warn("Proxy tunnel failed")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "tunneling is not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		p.log.WithFields(fields).WithError(err).Error("Failed to hijack proxy connection")
+		return
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+
+	var sent, received int64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// the client may have sent data along with the CONNECT request
+		sent, _ = io.Copy(target, buffered)
+		if conn, ok := target.(*net.TCPConn); ok {
+			conn.CloseWrite()
+		}
+	}()
+	received, _ = io.Copy(client, target)
+	client.Close()
+	wg.Wait()
+
+	fields["sent"] = sent
+	fields["received"] = received
+	p.log.WithFields(fields).Info("Proxied tunnel")
+}
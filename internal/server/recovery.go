@@ -0,0 +1,230 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reconcile brings the container map in line with the containers that exist in
+// Docker. Unknown containers, e.g. left over after a crash, are adopted or removed
+// depending on the recovery policy. Map entries whose container is gone are evicted.
+// Pooled containers that are not known to the pool are always removed, their
+// workspace mount does not survive a restart of the server.
+//
+// Containers tracked or changed after the list call are newer than the list,
+// they are neither evicted nor given the listed state. The map is only locked
+// to sort the containers, they are removed or adopted after unlocking.
+func (cm *ContainerManager) reconcile(ctx context.Context) error {
+	listed := cm.generation.Load()
+	containers, err := cm.runtime.ListContainers(ctx, cm.managedLabels(nil))
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	leftovers, untracked := cm.syncContainers(ctx, containers, listed)
+
+	for _, c := range leftovers {
+		cm.removePooledLeftover(ctx, c, c.Labels[poolLabel])
+	}
+	for _, c := range untracked {
+		if err := cm.recoverContainer(ctx, c); err != nil {
+			cm.log.WithError(err).WithField("containerID", c.ID).Error("Failed to recover container")
+		}
+	}
+	return nil
+}
+
+// syncContainers updates the state of the tracked containers and evicts the
+// ones that disappeared, releasing their networks. It returns the pooled
+// containers the pool does not know and the other untracked containers.
+func (cm *ContainerManager) syncContainers(ctx context.Context, containers []ContainerInfo, listed uint64) ([]ContainerInfo, []ContainerInfo) {
+	cm.containersMutex.Lock()
+	defer cm.containersMutex.Unlock()
+
+	var leftovers, untracked []ContainerInfo
+	tracked := make(map[string]*UserContainer)
+	for _, ct := range cm.containers {
+		tracked[ct.ID] = ct
+	}
+
+	existing := make(map[string]bool)
+	for _, c := range containers {
+		// containers of other server instances are left alone
+		if !cm.ownedByInstance(c.Labels) {
+			continue
+		}
+		existing[c.ID] = true
+
+		if ct, exists := tracked[c.ID]; exists {
+			ct.mutex.Lock()
+			if ct.generation <= listed {
+				ct.State = c.State
+			}
+			ct.mutex.Unlock()
+			continue
+		}
+
+		if slot := c.Labels[poolLabel]; slot != "" {
+			if cm.pool == nil || !cm.pool.Owns(slot) {
+				leftovers = append(leftovers, c)
+			}
+			continue
+		}
+		untracked = append(untracked, c)
+	}
+
+	for key, ct := range cm.containers {
+		ct.mutex.Lock()
+		stale := ct.generation <= listed
+		ct.mutex.Unlock()
+		if stale && !existing[ct.ID] {
+			cm.log.WithFields(logrus.Fields{
+				"user":        ct.User,
+				"workspace":   ct.Workspace,
+				"containerID": ct.ID,
+			}).Warn("Container disappeared, evicting")
+			delete(cm.containers, key)
+			if ct.Network != "" {
+				cm.releaseNetwork(ctx, ct.Network)
+			}
+		}
+	}
+
+	return leftovers, untracked
+}
+
+// recoverContainer adopts or removes a container that is not tracked yet. It
+// holds the lock of the user, so logins of the user wait for it.
+func (cm *ContainerManager) recoverContainer(ctx context.Context, c ContainerInfo) error {
+	ws := WorkspaceFromLabels(c.Labels)
+	unlock := cm.userLocks.Lock(ws.User)
+	defer unlock()
+
+	// the workspace got a container or one is being created or removed
+	cm.containersMutex.RLock()
+	_, exists := cm.containers[ws.Key()]
+	_, pending := cm.pending[ws.Key()]
+	_, tracked := cm.containerKey(c.ID)
+	cm.containersMutex.RUnlock()
+	if exists || pending || tracked {
+		return nil
+	}
+
+	// it may have been removed since the list call
+	info, err := cm.runtime.InspectContainer(ctx, c.ID)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to inspect container: %w", err)
+	}
+	c.State = info.State
+
+	fields := logrus.Fields{
+		"user":        ws.User,
+		"workspace":   ws.Name,
+		"containerID": c.ID,
+		"state":       c.State,
+	}
+
+	entry, known := cm.catalog.Get(c.Labels["de.mc8051.sshcontainer.image"])
+	if c.Labels["de.mc8051.sshcontainer.image"] == "" && len(cm.catalog.Entries) > 0 {
+		// containers created before the image catalog existed
+		entry, known = cm.catalog.Entries[0], true
+	}
+
+	adopt := cm.config.RecoveryPolicy == "adopt" && known && ws.Validate() == nil
+	if adopt {
+		entry, err = cm.imageDefaults(ctx, entry)
+		if err != nil {
+			cm.log.WithFields(fields).WithError(err).Warn("Cannot resolve image of container")
+			adopt = false
+		}
+		// the image may have been updated since the container was created
+		entry.ImageID = c.Labels["de.mc8051.sshcontainer.imageid"]
+	}
+
+	if !adopt {
+		cm.log.WithFields(fields).Info("Removing leftover container")
+		if err := cm.runtime.RemoveContainer(ctx, c.ID); err != nil {
+			return fmt.Errorf("failed to remove container: %w", err)
+		}
+		return cm.RemoveVFSMount(ctx, ContainerConfig{User: ws.User, Workspace: ws})
+	}
+
+	cm.log.WithFields(fields).Info("Adopting existing container")
+	ct := &UserContainer{
+		ID:        c.ID,
+		User:      ws.User,
+		Workspace: ws.Name,
+		Image:     entry,
+		State:     c.State,
+		Network:   c.Labels["de.mc8051.sshcontainer.network"],
+		LastUsed:  time.Now(),
+	}
+	cm.updateAddresses(ctx, ct)
+	cm.containersMutex.Lock()
+	cm.track(ws.Key(), ct)
+	cm.containersMutex.Unlock()
+	return nil
+}
+
+// removePooledLeftover removes a pooled container that is not tracked anymore
+func (cm *ContainerManager) removePooledLeftover(ctx context.Context, c ContainerInfo, slot string) {
+	fields := logrus.Fields{
+		"containerID": c.ID,
+		"slot":        slot,
+	}
+	// the labels of a claimed container still name the pool
+	if cm.pool != nil {
+		if ws, claimed := cm.pool.Owner(slot); claimed {
+			fields["user"] = ws.User
+			fields["workspace"] = ws.Name
+		}
+	}
+	cm.log.WithFields(fields).Info("Removing leftover pooled container")
+	if err := cm.runtime.RemoveContainer(ctx, c.ID); err != nil {
+		cm.log.WithError(err).WithField("containerID", c.ID).Error("Failed to remove pooled container")
+		return
+	}
+	if cm.pool != nil {
+		cm.pool.release(slot)
+	}
+}
+
+// ensureRunning starts or unpauses the container. The runtime is called
+// without ct.mutex, the caller must hold the lock of the user instead.
+func (cm *ContainerManager) ensureRunning(ctx context.Context, ct *UserContainer) error {
+	ct.mutex.Lock()
+	state := ct.State
+	ct.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, containerStartTimeout)
+	defer cancel()
+
+	switch state {
+	case "running":
+		return nil
+	case "paused":
+		if err := cm.changeState(ctx, ct, "running", cm.runtime.UnpauseContainer); err != nil {
+			return fmt.Errorf("failed to unpause container: %w", err)
+		}
+	default:
+		if err := cm.changeState(ctx, ct, "running", cm.runtime.StartContainer); err != nil {
+			return fmt.Errorf("failed to start container: %w", err)
+		}
+		// the runtime may assign new addresses on start
+		cm.updateAddresses(ctx, ct)
+	}
+
+	cm.log.WithFields(logrus.Fields{
+		"user":        ct.User,
+		"workspace":   ct.Workspace,
+		"containerID": ct.ID,
+		"state":       state,
+	}).Info("Resumed container")
+	return nil
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// createLeftover creates a container of the workspace that the manager does not track
+func createLeftover(t *testing.T, rt *fakeRuntime, ws Workspace) string {
+	t.Helper()
+	id, err := rt.CreateContainer(context.Background(), ContainerSpec{
+		Name: ws.ContainerName(""),
+		Labels: map[string]string{
+			managedLabel:                       "true",
+			"de.mc8051.sshcontainer.user":      ws.User,
+			"de.mc8051.sshcontainer.workspace": ws.Name,
+			"de.mc8051.sshcontainer.image":     testEntry.Name,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.StartContainer(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestReconcileRecoversLeftovers(t *testing.T) {
+	for _, policy := range []string{"adopt", "remove"} {
+		t.Run(policy, func(t *testing.T) {
+			rt := newFakeRuntime(0)
+			cm := newTestManager(rt)
+			cm.config.RecoveryPolicy = policy
+			ws := Workspace{User: "alice", Name: DefaultWorkspace}
+			id := createLeftover(t, rt, ws)
+
+			if err := cm.reconcile(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			_, tracked := cm.containerKey(id)
+			if adopt := policy == "adopt"; tracked != adopt || rt.exists(id) != adopt {
+				t.Errorf("tracked = %v, exists = %v", tracked, rt.exists(id))
+			}
+		})
+	}
+}
+
+func TestReconcileEvictsDisappearedContainers(t *testing.T) {
+	rt := newFakeRuntime(0)
+	cm := newTestManager(rt)
+	ws := Workspace{User: "alice", Name: DefaultWorkspace}
+	lease := login(t, cm, ws)
+	defer cm.ReleaseContainer(lease)
+
+	// removed behind the back of the manager
+	rt.mutex.Lock()
+	delete(rt.containers, lease.ContainerID)
+	rt.mutex.Unlock()
+
+	if err := cm.reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if status := cm.ContainerStatus(ws); status != "not running" {
+		t.Errorf("status = %q, want the container evicted", status)
+	}
+}
+
+// The isolated network of an evicted container is removed with it
+func TestEvictionReleasesNetwork(t *testing.T) {
+	evictions := map[string]func(cm *ContainerManager, id string) error{
+		"reconcile": func(cm *ContainerManager, id string) error {
+			return cm.reconcile(context.Background())
+		},
+		"destroy event": func(cm *ContainerManager, id string) error {
+			cm.handleEvent(ContainerEvent{ID: id, Action: "destroy"})
+			return nil
+		},
+	}
+	for name, evict := range evictions {
+		t.Run(name, func(t *testing.T) {
+			rt := newFakeRuntime(0)
+			cm := newTestManager(rt)
+			ws := Workspace{User: "alice", Name: DefaultWorkspace}
+			lease := login(t, cm, ws)
+			defer cm.ReleaseContainer(lease)
+			makeIdle(cm, ws).Network = "sshcontainer-net-alice"
+
+			// removed behind the back of the manager
+			rt.mutex.Lock()
+			delete(rt.containers, lease.ContainerID)
+			rt.mutex.Unlock()
+
+			if err := evict(cm, lease.ContainerID); err != nil {
+				t.Fatal(err)
+			}
+			if status := cm.ContainerStatus(ws); status != "not running" {
+				t.Errorf("status = %q, want the container evicted", status)
+			}
+			if networks := rt.removedNetworks(); len(networks) != 1 || networks[0] != "sshcontainer-net-alice" {
+				t.Errorf("removed networks = %v, want the network of the container", networks)
+			}
+		})
+	}
+}
+
+// Containers tracked after the list call are not in the list, but must not be evicted
+func TestReconcileKeepsContainersCreatedAfterList(t *testing.T) {
+	rt := newFakeRuntime(0)
+	cm := newTestManager(rt)
+	ws := Workspace{User: "alice", Name: DefaultWorkspace}
+
+	var lease *Lease
+	rt.listed = func() {
+		rt.listed = nil
+		lease = login(t, cm, ws)
+	}
+	if err := cm.reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer cm.ReleaseContainer(lease)
+
+	if _, tracked := cm.containerKey(lease.ContainerID); !tracked {
+		t.Fatalf("container %s created after the list was evicted", lease.ContainerID)
+	}
+	if status := cm.ContainerStatus(ws); status != "running, 1 active session(s)" {
+		t.Errorf("status = %q, want the lease kept", status)
+	}
+}
+
+// A state changed after the list call is newer than the listed state
+func TestReconcileKeepsStateChangedAfterList(t *testing.T) {
+	rt := newFakeRuntime(0)
+	cm := newTestManager(rt)
+	ws := Workspace{User: "alice", Name: DefaultWorkspace}
+	cm.ReleaseContainer(login(t, cm, ws))
+	ct := makeIdle(cm, ws)
+
+	rt.listed = func() {
+		rt.listed = nil
+		if err := cm.changeState(context.Background(), ct, "paused", rt.PauseContainer); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := cm.reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if status := cm.ContainerStatus(ws); status != "paused" {
+		t.Errorf("status = %q, want the state set after the list", status)
+	}
+
+	// without changes the listed state is taken
+	if err := rt.UnpauseContainer(context.Background(), ct.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if status := cm.ContainerStatus(ws); status != "running, 0 active session(s)" {
+		t.Errorf("status = %q, want the listed state", status)
+	}
+}
+
+// A user logging in while reconcile removes a leftover container of the
+// workspace waits for the removal, the new container would conflict with the
+// name of the old one
+func TestReconnectDuringLeftoverRemoval(t *testing.T) {
+	rt := newFakeRuntime(0)
+	cm := newTestManager(rt)
+	cm.config.RecoveryPolicy = "remove"
+	ws := Workspace{User: "alice", Name: DefaultWorkspace}
+	leftover := createLeftover(t, rt, ws)
+
+	removing, release := blockRemovals(rt)
+	reconciled := make(chan error, 1)
+	go func() {
+		reconciled <- cm.reconcile(context.Background())
+	}()
+	<-removing
+
+	// the map is not locked during the removal
+	waitFor(t, "ContainerStatus", func() { cm.ContainerStatus(ws) })
+	waitFor(t, "login of another user", func() {
+		cm.ReleaseContainer(login(t, cm, Workspace{User: "bob", Name: DefaultWorkspace}))
+	})
+
+	loggedIn := make(chan *Lease, 1)
+	go func() {
+		lease, _, err := cm.GetOrCreateContainer(context.Background(), ws, testEntry, Limits{}, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		loggedIn <- lease
+	}()
+	select {
+	case <-loggedIn:
+		t.Fatal("login did not wait for the removal")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	if err := <-reconciled; err != nil {
+		t.Fatal(err)
+	}
+	lease := <-loggedIn
+	if lease == nil {
+		t.FailNow()
+	}
+	defer cm.ReleaseContainer(lease)
+	if rt.exists(leftover) {
+		t.Errorf("leftover %s was not removed", leftover)
+	}
+	if !rt.running(lease.ContainerID) {
+		t.Errorf("new container %s is not running", lease.ContainerID)
+	}
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// dockerHubAuthKey is the key Docker uses for Docker Hub in config.json
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// RegistryAuth are the credentials sent with an image pull
+type RegistryAuth struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	ServerAddress string `json:"serveraddress,omitempty"`
+}
+
+// Encode returns the credentials in the X-Registry-Auth header format
+func (a *RegistryAuth) Encode() (string, error) {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+// RegistryCredentials are the registry logins of a Docker config.json
+type RegistryCredentials struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredHelpers map[string]string `json:"credHelpers"`
+	CredsStore  string            `json:"credsStore"`
+}
+
+// LoadRegistryCredentials reads a Docker config.json. Without a path no credentials are used.
+func LoadRegistryCredentials(path string) (*RegistryCredentials, error) {
+	creds := &RegistryCredentials{}
+	if path == "" {
+		return creds, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry auth file: %w", err)
+	}
+	if err := json.Unmarshal(data, creds); err != nil {
+		return nil, fmt.Errorf("failed to parse registry auth file: %w", err)
+	}
+	return creds, nil
+}
+
+// registryHost strips the scheme and path of a config.json key
+func registryHost(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	host, _, _ := strings.Cut(key, "/")
+	if host == "index.docker.io" || host == "registry-1.docker.io" {
+		return "docker.io"
+	}
+	return host
+}
+
+// Lookup returns the credentials for the registry of the image or nil if there are none.
+// Like Docker, a credential helper for the registry wins over the credential store,
+// which wins over the plain auths.
+func (c *RegistryCredentials) Lookup(ctx context.Context, image reference.Named) (*RegistryAuth, error) {
+	domain := reference.Domain(image)
+	serverAddress := domain
+	if domain == "docker.io" {
+		serverAddress = dockerHubAuthKey
+	}
+
+	for key, helper := range c.CredHelpers {
+		if registryHost(key) == domain {
+			return credentialHelper(ctx, helper, serverAddress)
+		}
+	}
+	if c.CredsStore != "" {
+		return credentialHelper(ctx, c.CredsStore, serverAddress)
+	}
+
+	for key, entry := range c.Auths {
+		if registryHost(key) != domain {
+			continue
+		}
+
+		auth := &RegistryAuth{
+			Username:      entry.Username,
+			Password:      entry.Password,
+			IdentityToken: entry.IdentityToken,
+			ServerAddress: serverAddress,
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth for registry %s: %w", key, err)
+			}
+			auth.Username, auth.Password, _ = strings.Cut(string(decoded), ":")
+		}
+		return auth, nil
+	}
+	return nil, nil
+}
+
+// credentialHelper runs docker-credential-<helper> get for the server address
+func credentialHelper(ctx context.Context, helper, serverAddress string) (*RegistryAuth, error) {
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverAddress)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stdout.String()+stderr.String(), "credentials not found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("credential helper %s failed: %w: %s", helper, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var resp struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("invalid response of credential helper %s: %w", helper, err)
+	}
+
+	auth := &RegistryAuth{ServerAddress: serverAddress}
+	if resp.Username == "<token>" {
+		auth.IdentityToken = resp.Secret
+	} else {
+		auth.Username = resp.Username
+		auth.Password = resp.Secret
+	}
+	return auth, nil
+}
+
+// NormalizeImage turns references like "ubuntu" into "docker.io/library/ubuntu:latest".
+// References pinned with a digest are kept without the default tag.
+func NormalizeImage(image string) (reference.Named, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image reference %q: %w", image, err)
+	}
+	return reference.TagNameOnly(named), nil
+}
+
+// DigestAllowlist is the set of image digests users may run. A nil list allows every image.
+type DigestAllowlist map[digest.Digest]bool
+
+// LoadDigestAllowlist reads one digest like "sha256:..." per line. Empty lines
+// and lines starting with # are ignored.
+func LoadDigestAllowlist(path string) (DigestAllowlist, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read digest allowlist: %w", err)
+	}
+	defer file.Close()
+
+	allowlist := make(DigestAllowlist)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		d, err := digest.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest in allowlist: %q", line)
+		}
+		allowlist[d] = true
+	}
+	return allowlist, scanner.Err()
+}
+
+// Allows reports whether one of the digests is on the allowlist
+func (l DigestAllowlist) Allows(digests ...digest.Digest) bool {
+	if l == nil {
+		return true
+	}
+	for _, d := range digests {
+		if l[d] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// ErrNotFound is returned by runtimes if a container, image or volume does not exist
+var ErrNotFound = errors.New("not found")
+
+// Runtime is the container engine user environments are scheduled on
+type Runtime interface {
+	// Name identifies the runtime in logs
+	Name() string
+	Info(ctx context.Context) (RuntimeInfo, error)
+
+	// PullImage pulls the image with the registry credentials, auth may be nil
+	PullImage(ctx context.Context, ref string, auth *RegistryAuth) error
+	ImageExists(ctx context.Context, ref string) (bool, error)
+	InspectImage(ctx context.Context, ref string) (ImageInfo, error)
+
+	CreateContainer(ctx context.Context, spec ContainerSpec) (string, error)
+	StartContainer(ctx context.Context, id string) error
+	PauseContainer(ctx context.Context, id string) error
+	UnpauseContainer(ctx context.Context, id string) error
+	StopContainer(ctx context.Context, id string) error
+	InspectContainer(ctx context.Context, id string) (ContainerInfo, error)
+	ContainerStats(ctx context.Context, id string) (ContainerStats, error)
+	ListContainers(ctx context.Context, labels map[string]string) ([]ContainerInfo, error)
+	RemoveContainer(ctx context.Context, id string) error
+	RenameContainer(ctx context.Context, id, name string) error
+	// CreateNetwork creates the network unless it exists and reports whether it was created
+	CreateNetwork(ctx context.Context, spec NetworkSpec) (bool, error)
+	RemoveNetwork(ctx context.Context, name string) error
+	ConnectNetwork(ctx context.Context, network, id string, aliases []string) error
+	DisconnectNetwork(ctx context.Context, network, id string) error
+	AttachContainer(ctx context.Context, id string) (Stream, error)
+	ResizeContainer(ctx context.Context, id string, height, width uint) error
+	// Events streams lifecycle events of containers with the labels until ctx is
+	// cancelled or an error is sent
+	Events(ctx context.Context, labels map[string]string) (<-chan ContainerEvent, <-chan error)
+
+	Exec(ctx context.Context, id string, spec ExecSpec) (Stream, string, error)
+	// ExecExitCode returns the exit code of a finished exec. Runtimes reporting
+	// the exit status as error of the stream return 0.
+	ExecExitCode(ctx context.Context, execID string) (int, error)
+	ResizeExec(ctx context.Context, execID string, height, width uint) error
+
+	CreateVolume(ctx context.Context, spec VolumeSpec) error
+	VolumeExists(ctx context.Context, name string) (bool, error)
+	RemoveVolume(ctx context.Context, name string) error
+}
+
+// ManagedStorage is implemented by runtimes that provision persistent workspace
+// volumes themselves instead of mounting the local btrfs VFS. Their volumes are
+// kept when a container is removed.
+type ManagedStorage interface {
+	ListVolumes(ctx context.Context, labels map[string]string) ([]VolumeInfo, error)
+}
+
+// Stream is an attached container or exec stream. Output is multiplexed in the
+// Docker stdcopy format unless a TTY was requested.
+type Stream interface {
+	io.Reader
+	io.Writer
+	CloseWrite() error
+	Close() error
+}
+
+type MountType string
+
+const (
+	MountVolume MountType = "volume"
+	MountBind   MountType = "bind"
+	MountTmpfs  MountType = "tmpfs"
+)
+
+type Mount struct {
+	Type     MountType
+	Source   string
+	Target   string
+	ReadOnly bool
+	// bind only, e.g. rslave to see mounts made below the source later on
+	Propagation string
+	// tmpfs only
+	SizeBytes int64
+	Mode      os.FileMode
+}
+
+type Resources struct {
+	MemoryBytes int64
+	// memory plus swap, -1 allows unlimited swap
+	MemorySwapBytes int64
+	NanoCPUs        int64
+	PidsLimit       int64
+	BlkioWeight     uint16
+	DeviceReadBps   []ThrottleDevice
+	DeviceWriteBps  []ThrottleDevice
+	DeviceReadIops  []ThrottleDevice
+	DeviceWriteIops []ThrottleDevice
+	Ulimits         []Ulimit
+	OomScoreAdj     int
+}
+
+// ThrottleDevice limits the bytes or IO operations per second on a block device
+type ThrottleDevice struct {
+	Path string
+	Rate uint64
+}
+
+type Ulimit struct {
+	Name string // e.g. nofile, nproc or core
+	Soft int64
+	Hard int64
+}
+
+// RuntimeInfo describes the container engine
+type RuntimeInfo struct {
+	Rootless bool
+	// UID and GID of the user running a rootless engine, root of containers maps to them
+	UID int
+	GID int
+}
+
+// ContainerSpec describes a user container independent of the runtime
+type ContainerSpec struct {
+	Name        string
+	Image       string
+	Cmd         []string
+	Env         []string
+	Labels      map[string]string
+	Mounts      []Mount
+	NetworkMode string
+	// The container is created in the first network and connected to the others afterwards
+	Networks    []string
+	DNS         []string // resolvers of the container, empty for the runtime default
+	Devices     []string
+	CapAdd      []string
+	SecurityOpt []string
+	Security    SecurityProfile
+	ReadOnly    bool
+	Resources   Resources
+	UsernsMode  string
+	// IDMapping gives the container its own range of host IDs, nil for the runtime default
+	IDMapping *IDMapping
+}
+
+// ContainerStats is a sample of the resource usage of a container. Limits are 0 if unknown.
+type ContainerStats struct {
+	MemoryBytes      uint64 // without the page cache
+	MemoryLimitBytes uint64
+	CPUPercent       float64 // 100 is one CPU
+	Pids             uint64
+	PidsLimit        uint64
+	NetworkRxBytes   uint64
+	NetworkTxBytes   uint64
+}
+
+type ContainerInfo struct {
+	ID      string
+	Name    string
+	Image   string
+	State   string
+	Labels  map[string]string
+	Network map[string]string // network name to IP address
+}
+
+// ContainerEvent is a lifecycle event of a container. Actions use the Docker
+// names, e.g. oom, die and destroy.
+type ContainerEvent struct {
+	ID       string
+	Action   string
+	ExitCode int
+}
+
+type ImageInfo struct {
+	ID          string
+	RepoTags    []string
+	RepoDigests []string
+	Labels      map[string]string
+	User        string
+	WorkingDir  string
+}
+
+type ExecSpec struct {
+	Cmd        []string
+	Env        []string
+	User       string
+	WorkingDir string
+	Tty        bool
+}
+
+// NetworkSpec describes a bridge network. Internal networks have no route to the outside.
+type NetworkSpec struct {
+	Name     string
+	Labels   map[string]string
+	Internal bool
+}
+
+type VolumeSpec struct {
+	Name       string
+	Driver     string
+	DriverOpts map[string]string
+	Labels     map[string]string
+	SizeBytes  int64
+}
+
+type VolumeInfo struct {
+	Name   string
+	Labels map[string]string
+}
+
+// socketOwner returns the owner of a unix socket, the user running a rootless engine
+func socketOwner(path string) (int, int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to stat socket: %w", err)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, fmt.Errorf("failed to get owner of socket %s", path)
+	}
+	return int(stat.Uid), int(stat.Gid), nil
+}
+
+// NewRuntime creates the runtime selected in the config
+func NewRuntime(config *Config) (Runtime, error) {
+	switch config.Runtime {
+	case "docker":
+		return NewDockerRuntime()
+	case "podman":
+		return NewPodmanRuntime(config.PodmanSocket, config.SeccompProfileHostDir)
+	case "kubernetes":
+		return NewKubernetesRuntime(config)
+	default:
+		return nil, fmt.Errorf("unknown container runtime: %s", config.Runtime)
+	}
+}
@@ -0,0 +1,513 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/blkiodev"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+// DockerRuntime runs user containers on the Docker Engine API
+type DockerRuntime struct {
+	client *client.Client
+}
+
+func NewDockerRuntime() (*DockerRuntime, error) {
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	return &DockerRuntime{client: dockerClient}, nil
+}
+
+func (r *DockerRuntime) Name() string {
+	return "docker"
+}
+
+func (r *DockerRuntime) Info(ctx context.Context) (RuntimeInfo, error) {
+	info, err := r.client.Info(ctx)
+	if err != nil {
+		return RuntimeInfo{}, fmt.Errorf("failed to get docker info: %w", err)
+	}
+	if !slices.Contains(info.SecurityOptions, "name=rootless") {
+		return RuntimeInfo{}, nil
+	}
+
+	uid, gid, err := socketOwner(strings.TrimPrefix(r.client.DaemonHost(), "unix://"))
+	if err != nil {
+		return RuntimeInfo{}, err
+	}
+	return RuntimeInfo{Rootless: true, UID: uid, GID: gid}, nil
+}
+
+func dockerError(err error) error {
+	if errdefs.IsNotFound(err) {
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	return err
+}
+
+func (r *DockerRuntime) PullImage(ctx context.Context, ref string, auth *RegistryAuth) error {
+	var options image.PullOptions
+	if auth != nil {
+		encoded, err := auth.Encode()
+		if err != nil {
+			return fmt.Errorf("failed to encode registry auth: %w", err)
+		}
+		options.RegistryAuth = encoded
+	}
+
+	out, err := r.client.ImagePull(ctx, ref, options)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	// the pull only completes once the progress stream is consumed
+	_, err = io.Copy(io.Discard, out)
+	return err
+}
+
+func (r *DockerRuntime) ImageExists(ctx context.Context, ref string) (bool, error) {
+	// the daemon resolves short names, tags and digests like the pull does
+	_, _, err := r.client.ImageInspectWithRaw(ctx, ref)
+	if errdefs.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("failed to inspect image: %w", err)
+	}
+	return true, nil
+}
+
+func (r *DockerRuntime) InspectImage(ctx context.Context, ref string) (ImageInfo, error) {
+	img, _, err := r.client.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return ImageInfo{}, dockerError(err)
+	}
+
+	info := ImageInfo{
+		ID:          img.ID,
+		RepoTags:    img.RepoTags,
+		RepoDigests: img.RepoDigests,
+	}
+	if img.Config != nil {
+		info.Labels = img.Config.Labels
+		info.User = img.Config.User
+		info.WorkingDir = img.Config.WorkingDir
+	}
+	return info, nil
+}
+
+func (r *DockerRuntime) CreateContainer(ctx context.Context, spec ContainerSpec) (string, error) {
+	if spec.IDMapping != nil {
+		return "", fmt.Errorf("docker does not support ID mappings per container, use userns-remap of the daemon")
+	}
+
+	containerConfig := &container.Config{
+		Image:     spec.Image,
+		Env:       spec.Env,
+		Cmd:       spec.Cmd,
+		OpenStdin: true,
+		Labels:    spec.Labels,
+	}
+
+	var devMappings []container.DeviceMapping
+	for _, dev := range spec.Devices {
+		devMappings = append(devMappings, container.DeviceMapping{
+			PathOnHost:        dev,
+			PathInContainer:   dev,
+			CgroupPermissions: "rwm",
+		})
+	}
+
+	mounts := make([]mount.Mount, 0, len(spec.Mounts))
+	for _, m := range spec.Mounts {
+		dockerMount := mount.Mount{
+			Type:     mount.Type(m.Type),
+			Source:   m.Source,
+			Target:   m.Target,
+			ReadOnly: m.ReadOnly,
+		}
+		if m.Type == MountBind && m.Propagation != "" {
+			dockerMount.BindOptions = &mount.BindOptions{
+				Propagation: mount.Propagation(m.Propagation),
+			}
+		}
+		if m.Type == MountTmpfs {
+			dockerMount.TmpfsOptions = &mount.TmpfsOptions{
+				SizeBytes: m.SizeBytes,
+				Mode:      m.Mode,
+			}
+		}
+		mounts = append(mounts, dockerMount)
+	}
+
+	var ulimits []*container.Ulimit
+	for _, u := range spec.Resources.Ulimits {
+		ulimits = append(ulimits, &container.Ulimit{Name: u.Name, Soft: u.Soft, Hard: u.Hard})
+	}
+
+	var pidsLimit *int64
+	if spec.Resources.PidsLimit > 0 {
+		pidsLimit = &spec.Resources.PidsLimit
+	}
+
+	throttle := func(devices []ThrottleDevice) []*blkiodev.ThrottleDevice {
+		result := make([]*blkiodev.ThrottleDevice, 0, len(devices))
+		for _, d := range devices {
+			result = append(result, &blkiodev.ThrottleDevice{Path: d.Path, Rate: d.Rate})
+		}
+		return result
+	}
+
+	// options of the security profile come first, so SecurityOpt can override them
+	securityOpt := make([]string, 0, len(spec.SecurityOpt)+2)
+	if spec.Security.Seccomp != nil {
+		securityOpt = append(securityOpt, "seccomp="+string(spec.Security.Seccomp))
+	}
+	if spec.Security.AppArmor != "" {
+		securityOpt = append(securityOpt, "apparmor="+spec.Security.AppArmor)
+	}
+	securityOpt = append(securityOpt, spec.SecurityOpt...)
+
+	hostConfig := &container.HostConfig{
+		NetworkMode:    container.NetworkMode(spec.NetworkMode),
+		UsernsMode:     container.UsernsMode(spec.UsernsMode),
+		DNS:            spec.DNS,
+		CapAdd:         spec.CapAdd,
+		SecurityOpt:    securityOpt,
+		ReadonlyRootfs: spec.ReadOnly,
+		OomScoreAdj:    spec.Resources.OomScoreAdj,
+		Mounts:         mounts,
+		Resources: container.Resources{
+			Memory:      spec.Resources.MemoryBytes,
+			MemorySwap:  spec.Resources.MemorySwapBytes,
+			NanoCPUs:    spec.Resources.NanoCPUs,
+			PidsLimit:   pidsLimit,
+			BlkioWeight: spec.Resources.BlkioWeight,
+			Ulimits:     ulimits,
+			Devices:     devMappings,
+
+			BlkioDeviceReadBps:   throttle(spec.Resources.DeviceReadBps),
+			BlkioDeviceWriteBps:  throttle(spec.Resources.DeviceWriteBps),
+			BlkioDeviceReadIOps:  throttle(spec.Resources.DeviceReadIops),
+			BlkioDeviceWriteIOps: throttle(spec.Resources.DeviceWriteIops),
+		},
+	}
+
+	networkingConfig := &network.NetworkingConfig{}
+	if len(spec.Networks) > 0 {
+		networkingConfig.EndpointsConfig = map[string]*network.EndpointSettings{
+			spec.Networks[0]: {},
+		}
+	}
+
+	resp, err := r.client.ContainerCreate(ctx, containerConfig, hostConfig, networkingConfig, nil, spec.Name)
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+func (r *DockerRuntime) StartContainer(ctx context.Context, id string) error {
+	return dockerError(r.client.ContainerStart(ctx, id, container.StartOptions{}))
+}
+
+func (r *DockerRuntime) PauseContainer(ctx context.Context, id string) error {
+	return dockerError(r.client.ContainerPause(ctx, id))
+}
+
+func (r *DockerRuntime) UnpauseContainer(ctx context.Context, id string) error {
+	return dockerError(r.client.ContainerUnpause(ctx, id))
+}
+
+func (r *DockerRuntime) StopContainer(ctx context.Context, id string) error {
+	return dockerError(r.client.ContainerStop(ctx, id, container.StopOptions{}))
+}
+
+func (r *DockerRuntime) InspectContainer(ctx context.Context, id string) (ContainerInfo, error) {
+	ct, err := r.client.ContainerInspect(ctx, id)
+	if err != nil {
+		return ContainerInfo{}, dockerError(err)
+	}
+
+	info := ContainerInfo{
+		ID:      ct.ID,
+		Name:    strings.TrimPrefix(ct.Name, "/"),
+		Image:   ct.Image,
+		Network: make(map[string]string),
+	}
+	if ct.State != nil {
+		info.State = ct.State.Status
+	}
+	if ct.Config != nil {
+		info.Labels = ct.Config.Labels
+	}
+	if ct.NetworkSettings != nil {
+		for name, settings := range ct.NetworkSettings.Networks {
+			info.Network[name] = settings.IPAddress
+		}
+	}
+	return info, nil
+}
+
+// ContainerStats waits for a second sample to calculate the CPU usage
+func (r *DockerRuntime) ContainerStats(ctx context.Context, id string) (ContainerStats, error) {
+	resp, err := r.client.ContainerStats(ctx, id, false)
+	if err != nil {
+		return ContainerStats{}, fmt.Errorf("failed to get container stats: %w", dockerError(err))
+	}
+	defer resp.Body.Close()
+
+	var s container.StatsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return ContainerStats{}, fmt.Errorf("failed to decode container stats: %w", err)
+	}
+
+	stats := ContainerStats{
+		MemoryBytes:      s.MemoryStats.Usage,
+		MemoryLimitBytes: s.MemoryStats.Limit,
+		Pids:             s.PidsStats.Current,
+		PidsLimit:        s.PidsStats.Limit,
+	}
+	// like docker stats, the inactive page cache is not counted (cgroup v2 and v1)
+	for _, key := range []string{"inactive_file", "total_inactive_file"} {
+		if cache, exists := s.MemoryStats.Stats[key]; exists && cache < stats.MemoryBytes {
+			stats.MemoryBytes -= cache
+			break
+		}
+	}
+
+	cpuDelta := float64(s.CPUStats.CPUUsage.TotalUsage) - float64(s.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(s.CPUStats.SystemUsage) - float64(s.PreCPUStats.SystemUsage)
+	if cpuDelta > 0 && systemDelta > 0 {
+		stats.CPUPercent = cpuDelta / systemDelta * float64(s.CPUStats.OnlineCPUs) * 100
+	}
+
+	for _, network := range s.Networks {
+		stats.NetworkRxBytes += network.RxBytes
+		stats.NetworkTxBytes += network.TxBytes
+	}
+	return stats, nil
+}
+
+func (r *DockerRuntime) ListContainers(ctx context.Context, labels map[string]string) ([]ContainerInfo, error) {
+	filterArgs := filters.NewArgs()
+	for k, v := range labels {
+		filterArgs.Add("label", fmt.Sprintf("%s=%s", k, v))
+	}
+
+	containers, err := r.client.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filterArgs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]ContainerInfo, 0, len(containers))
+	for _, c := range containers {
+		info := ContainerInfo{
+			ID:      c.ID,
+			Image:   c.ImageID,
+			State:   c.State,
+			Labels:  c.Labels,
+			Network: make(map[string]string),
+		}
+		if len(c.Names) > 0 {
+			info.Name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		if c.NetworkSettings != nil {
+			for name, settings := range c.NetworkSettings.Networks {
+				info.Network[name] = settings.IPAddress
+			}
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+func (r *DockerRuntime) RemoveContainer(ctx context.Context, id string) error {
+	return dockerError(r.client.ContainerRemove(ctx, id, container.RemoveOptions{
+		Force:         true,
+		RemoveVolumes: true,
+	}))
+}
+
+func (r *DockerRuntime) RenameContainer(ctx context.Context, id, name string) error {
+	return dockerError(r.client.ContainerRename(ctx, id, name))
+}
+
+func (r *DockerRuntime) CreateNetwork(ctx context.Context, spec NetworkSpec) (bool, error) {
+	if _, err := r.client.NetworkInspect(ctx, spec.Name, network.InspectOptions{}); err == nil {
+		return false, nil
+	} else if !errdefs.IsNotFound(err) {
+		return false, err
+	}
+
+	_, err := r.client.NetworkCreate(ctx, spec.Name, network.CreateOptions{
+		Driver:   "bridge",
+		Internal: spec.Internal,
+		Labels:   spec.Labels,
+	})
+	if errdefs.IsConflict(err) {
+		// created concurrently
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *DockerRuntime) RemoveNetwork(ctx context.Context, name string) error {
+	return dockerError(r.client.NetworkRemove(ctx, name))
+}
+
+func (r *DockerRuntime) ConnectNetwork(ctx context.Context, networkName, id string, aliases []string) error {
+	return r.client.NetworkConnect(ctx, networkName, id, &network.EndpointSettings{Aliases: aliases})
+}
+
+func (r *DockerRuntime) DisconnectNetwork(ctx context.Context, networkName, id string) error {
+	return dockerError(r.client.NetworkDisconnect(ctx, networkName, id, false))
+}
+
+func (r *DockerRuntime) AttachContainer(ctx context.Context, id string) (Stream, error) {
+	resp, err := r.client.ContainerAttach(ctx, id, container.AttachOptions{
+		Stream: true,
+		Stdin:  true,
+		Stdout: true,
+		Stderr: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &dockerStream{resp: resp}, nil
+}
+
+func (r *DockerRuntime) ResizeContainer(ctx context.Context, id string, height, width uint) error {
+	return r.client.ContainerResize(ctx, id, container.ResizeOptions{
+		Height: height,
+		Width:  width,
+	})
+}
+
+func (r *DockerRuntime) Events(ctx context.Context, labels map[string]string) (<-chan ContainerEvent, <-chan error) {
+	filterArgs := filters.NewArgs(filters.Arg("type", string(events.ContainerEventType)))
+	for k, v := range labels {
+		filterArgs.Add("label", fmt.Sprintf("%s=%s", k, v))
+	}
+
+	messages, errs := r.client.Events(ctx, events.ListOptions{Filters: filterArgs})
+	result := make(chan ContainerEvent)
+	go func() {
+		for {
+			select {
+			case msg := <-messages:
+				exitCode, _ := strconv.Atoi(msg.Actor.Attributes["exitCode"])
+				select {
+				case result <- ContainerEvent{ID: msg.Actor.ID, Action: string(msg.Action), ExitCode: exitCode}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return result, errs
+}
+
+func (r *DockerRuntime) Exec(ctx context.Context, id string, spec ExecSpec) (Stream, string, error) {
+	execCreateResp, err := r.client.ContainerExecCreate(ctx, id, container.ExecOptions{
+		User:         spec.User,
+		Tty:          spec.Tty,
+		AttachStdin:  true,
+		AttachStderr: true,
+		AttachStdout: true,
+		Env:          spec.Env,
+		Cmd:          spec.Cmd,
+		WorkingDir:   spec.WorkingDir,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create exec: %w", dockerError(err))
+	}
+
+	resp, err := r.client.ContainerExecAttach(ctx, execCreateResp.ID, container.ExecAttachOptions{
+		Tty: spec.Tty,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to attach to exec: %w", err)
+	}
+	return &dockerStream{resp: resp}, execCreateResp.ID, nil
+}
+
+func (r *DockerRuntime) ExecExitCode(ctx context.Context, execID string) (int, error) {
+	inspect, err := r.client.ContainerExecInspect(ctx, execID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to inspect exec: %w", dockerError(err))
+	}
+	return inspect.ExitCode, nil
+}
+
+func (r *DockerRuntime) ResizeExec(ctx context.Context, execID string, height, width uint) error {
+	return r.client.ContainerExecResize(ctx, execID, container.ResizeOptions{
+		Height: height,
+		Width:  width,
+	})
+}
+
+func (r *DockerRuntime) CreateVolume(ctx context.Context, spec VolumeSpec) error {
+	_, err := r.client.VolumeCreate(ctx, volume.CreateOptions{
+		Name:       spec.Name,
+		Driver:     spec.Driver,
+		DriverOpts: spec.DriverOpts,
+		Labels:     spec.Labels,
+	})
+	return err
+}
+
+func (r *DockerRuntime) VolumeExists(ctx context.Context, name string) (bool, error) {
+	_, err := r.client.VolumeInspect(ctx, name)
+	if errdefs.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *DockerRuntime) RemoveVolume(ctx context.Context, name string) error {
+	return dockerError(r.client.VolumeRemove(ctx, name, true))
+}
+
+// dockerStream adapts a hijacked connection to the Stream interface
+type dockerStream struct {
+	resp types.HijackedResponse
+}
+
+func (s *dockerStream) Read(p []byte) (int, error) {
+	return s.resp.Reader.Read(p)
+}
+
+func (s *dockerStream) Write(p []byte) (int, error) {
+	return s.resp.Conn.Write(p)
+}
+
+func (s *dockerStream) CloseWrite() error {
+	return s.resp.CloseWrite()
+}
+
+func (s *dockerStream) Close() error {
+	s.resp.Close()
+	return nil
+}
@@ -0,0 +1,800 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8slabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	// kubeContainerName is the name of the workspace container inside the pod
+	kubeContainerName = "workspace"
+	kubeStartTimeout  = 5 * time.Minute
+	kubeNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+var kubeNameRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// kubeSwitchUser runs the command as the user in $0, by name or ID. Only root
+// can switch users, runuser fails for other users.
+const kubeSwitchUser = `if [ "$(id -un)" = "$0" ] || [ "$(id -u)" = "$0" ]; then exec "$@"; fi; exec runuser -u "$0" -- "$@"`
+
+// ExecutorFactory opens an exec or attach connection to the given URL
+type ExecutorFactory func(method string, url *url.URL) (remotecommand.Executor, error)
+
+// KubernetesRuntime runs every workspace as a pod with a persistent volume claim.
+// Container IDs are pod names and volumes are PVCs.
+type KubernetesRuntime struct {
+	client       kubernetes.Interface
+	namespace    string
+	storageClass string
+	newExecutor  ExecutorFactory
+
+	sizeQueues      map[string]*kubeSizeQueue // map of exec or pod name to the resize queue
+	sizeQueuesMutex sync.Mutex
+}
+
+func NewKubernetesRuntime(config *Config) (*KubernetesRuntime, error) {
+	var restConfig *rest.Config
+	var err error
+	if config.KubeConfig != "" {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", config.KubeConfig)
+	} else {
+		restConfig, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load Kubernetes config: %w", err)
+	}
+
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+
+	namespace := config.KubeNamespace
+	if namespace == "" {
+		if data, err := os.ReadFile(kubeNamespaceFile); err == nil {
+			namespace = strings.TrimSpace(string(data))
+		} else {
+			namespace = metav1.NamespaceDefault
+		}
+	}
+
+	return NewKubernetesRuntimeWithClient(client, namespace, config.KubeStorageClass, defaultExecutorFactory(restConfig)), nil
+}
+
+// NewKubernetesRuntimeWithClient creates a runtime on an existing client, e.g. a fake clientset
+func NewKubernetesRuntimeWithClient(client kubernetes.Interface, namespace, storageClass string, newExecutor ExecutorFactory) *KubernetesRuntime {
+	return &KubernetesRuntime{
+		client:       client,
+		namespace:    namespace,
+		storageClass: storageClass,
+		newExecutor:  newExecutor,
+		sizeQueues:   make(map[string]*kubeSizeQueue),
+	}
+}
+
+// defaultExecutorFactory prefers the WebSocket protocol and falls back to SPDY
+// on API servers that do not support it
+func defaultExecutorFactory(restConfig *rest.Config) ExecutorFactory {
+	return func(method string, u *url.URL) (remotecommand.Executor, error) {
+		websocket, err := remotecommand.NewWebSocketExecutor(restConfig, "GET", u.String())
+		if err != nil {
+			return nil, err
+		}
+		spdy, err := remotecommand.NewSPDYExecutor(restConfig, method, u)
+		if err != nil {
+			return nil, err
+		}
+		return remotecommand.NewFallbackExecutor(websocket, spdy, func(err error) bool {
+			return httpstream.IsUpgradeFailure(err) || httpstream.IsHTTPSProxyError(err)
+		})
+	}
+}
+
+func (r *KubernetesRuntime) Name() string {
+	return "kubernetes"
+}
+
+// Info reports a rootful engine, pods get user namespaces with hostUsers
+func (r *KubernetesRuntime) Info(ctx context.Context) (RuntimeInfo, error) {
+	return RuntimeInfo{}, nil
+}
+
+func kubeError(err error) error {
+	if apierrors.IsNotFound(err) {
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	return err
+}
+
+// kubeName turns a container or volume name into a valid object name. Names
+// that have to be changed get a hash suffix so they stay unique.
+func kubeName(name string) string {
+	if kubeNameRegex.MatchString(name) {
+		return name
+	}
+
+	sanitized := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r + ('a' - 'A')
+		}
+		return '-'
+	}, name)
+	if len(sanitized) > 54 {
+		sanitized = sanitized[:54]
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	return strings.Trim(sanitized, "-") + "-" + hex.EncodeToString(sum[:4])
+}
+
+// kubeLabelValue turns a label value into a valid Kubernetes label value.
+// Values that have to be changed get a hash suffix so they stay unique.
+func kubeLabelValue(value string) string {
+	if len(validation.IsValidLabelValue(value)) == 0 {
+		return value
+	}
+
+	sanitized := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '-'
+	}, value)
+	if len(sanitized) > 54 {
+		sanitized = sanitized[:54]
+	}
+	sanitized = strings.Trim(sanitized, "-_.")
+
+	sum := sha256.Sum256([]byte(value))
+	if sanitized == "" {
+		return hex.EncodeToString(sum[:4])
+	}
+	return sanitized + "-" + hex.EncodeToString(sum[:4])
+}
+
+// kubeLabels encodes the labels as Kubernetes label values. The raw values of
+// changed labels are returned as annotations under the same key.
+func kubeLabels(labels map[string]string) (map[string]string, map[string]string) {
+	encoded := make(map[string]string, len(labels))
+	var annotations map[string]string
+	for key, value := range labels {
+		encoded[key] = kubeLabelValue(value)
+		if encoded[key] != value {
+			if annotations == nil {
+				annotations = make(map[string]string)
+			}
+			annotations[key] = value
+		}
+	}
+	return encoded, annotations
+}
+
+// kubeSelector selects the objects with the labels, encoded like kubeLabels
+func kubeSelector(labels map[string]string) string {
+	encoded, _ := kubeLabels(labels)
+	return k8slabels.SelectorFromSet(encoded).String()
+}
+
+// decodeKubeLabels returns the raw labels of an object created with kubeLabels
+func decodeKubeLabels(meta metav1.ObjectMeta) map[string]string {
+	labels := make(map[string]string, len(meta.Labels))
+	for key, value := range meta.Labels {
+		if raw, ok := meta.Annotations[key]; ok && kubeLabelValue(raw) == value {
+			value = raw
+		}
+		labels[key] = value
+	}
+	return labels
+}
+
+// PullImage is a no-op, images are pulled by the kubelet when the pod is scheduled.
+// Credentials for private registries come from the imagePullSecrets of the
+// service account of the namespace.
+func (r *KubernetesRuntime) PullImage(ctx context.Context, ref string, auth *RegistryAuth) error {
+	return nil
+}
+
+func (r *KubernetesRuntime) ImageExists(ctx context.Context, ref string) (bool, error) {
+	return true, nil
+}
+
+// InspectImage cannot look into images on the nodes. Catalog entries should
+// set cmd, user and mountPath explicitly when running on Kubernetes.
+func (r *KubernetesRuntime) InspectImage(ctx context.Context, ref string) (ImageInfo, error) {
+	return ImageInfo{RepoTags: []string{ref}}, nil
+}
+
+func (r *KubernetesRuntime) CreateContainer(ctx context.Context, spec ContainerSpec) (string, error) {
+	if len(spec.Devices) > 0 {
+		return "", fmt.Errorf("devices are not supported on Kubernetes")
+	}
+
+	env := make([]corev1.EnvVar, 0, len(spec.Env))
+	for _, e := range spec.Env {
+		name, value, _ := strings.Cut(e, "=")
+		env = append(env, corev1.EnvVar{Name: name, Value: value})
+	}
+
+	var volumes []corev1.Volume
+	var volumeMounts []corev1.VolumeMount
+	for i, m := range spec.Mounts {
+		volume := corev1.Volume{Name: fmt.Sprintf("mount-%d", i)}
+		volumeMount := corev1.VolumeMount{
+			Name:      volume.Name,
+			MountPath: m.Target,
+			ReadOnly:  m.ReadOnly,
+		}
+		switch m.Type {
+		case MountVolume:
+			volume.PersistentVolumeClaim = &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: kubeName(m.Source),
+				ReadOnly:  m.ReadOnly,
+			}
+		case MountTmpfs:
+			volume.EmptyDir = &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}
+			if m.SizeBytes > 0 {
+				volume.EmptyDir.SizeLimit = resource.NewQuantity(m.SizeBytes, resource.BinarySI)
+			}
+		case MountBind:
+			volume.HostPath = &corev1.HostPathVolumeSource{Path: m.Source}
+			if m.Propagation != "" {
+				propagation := corev1.MountPropagationHostToContainer
+				volumeMount.MountPropagation = &propagation
+			}
+		default:
+			return "", fmt.Errorf("unsupported mount type: %s", m.Type)
+		}
+		volumes = append(volumes, volume)
+		volumeMounts = append(volumeMounts, volumeMount)
+	}
+
+	limits := corev1.ResourceList{}
+	if spec.Resources.MemoryBytes > 0 {
+		limits[corev1.ResourceMemory] = *resource.NewQuantity(spec.Resources.MemoryBytes, resource.BinarySI)
+	}
+	if spec.Resources.NanoCPUs > 0 {
+		limits[corev1.ResourceCPU] = *resource.NewMilliQuantity(spec.Resources.NanoCPUs/1e6, resource.DecimalSI)
+	}
+
+	securityContext := &corev1.SecurityContext{
+		ReadOnlyRootFilesystem: &spec.ReadOnly,
+	}
+	if len(spec.CapAdd) > 0 {
+		securityContext.Capabilities = &corev1.Capabilities{}
+		for _, capability := range spec.CapAdd {
+			securityContext.Capabilities.Add = append(securityContext.Capabilities.Add, corev1.Capability(strings.TrimPrefix(capability, "CAP_")))
+		}
+	}
+	// the seccomp profiles are files in the seccomp directory of the kubelet
+	securityContext.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+	if spec.Security.Seccomp != nil {
+		localhost := "sshcontainer/" + spec.Security.Name + ".json"
+		securityContext.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeLocalhost, LocalhostProfile: &localhost}
+	}
+	for _, opt := range spec.SecurityOpt {
+		if opt == "no-new-privileges" || opt == "no-new-privileges:true" {
+			allow := false
+			securityContext.AllowPrivilegeEscalation = &allow
+		}
+	}
+
+	automount := false
+	labels, annotations := kubeLabels(spec.Labels)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        kubeName(spec.Name),
+			Namespace:   r.namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy:                corev1.RestartPolicyAlways,
+			AutomountServiceAccountToken: &automount,
+			Volumes:                      volumes,
+			Containers: []corev1.Container{{
+				Name:            kubeContainerName,
+				Image:           spec.Image,
+				Args:            spec.Cmd,
+				Env:             env,
+				Stdin:           true,
+				VolumeMounts:    volumeMounts,
+				SecurityContext: securityContext,
+				Resources: corev1.ResourceRequirements{
+					Limits: limits,
+				},
+			}},
+		},
+	}
+
+	// the kubelet assigns every pod with its own user namespace a distinct ID range
+	if spec.IDMapping != nil || (spec.UsernsMode != "" && spec.UsernsMode != "host") {
+		hostUsers := false
+		pod.Spec.HostUsers = &hostUsers
+	}
+
+	if len(spec.DNS) > 0 {
+		pod.Spec.DNSPolicy = corev1.DNSNone
+		pod.Spec.DNSConfig = &corev1.PodDNSConfig{Nameservers: spec.DNS}
+	}
+
+	created, err := r.client.CoreV1().Pods(r.namespace).Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return "", err
+	}
+	return created.Name, nil
+}
+
+// StartContainer waits for the pod to run, pods are started on creation
+func (r *KubernetesRuntime) StartContainer(ctx context.Context, id string) error {
+	return wait.PollUntilContextTimeout(ctx, time.Second, kubeStartTimeout, true, func(ctx context.Context) (bool, error) {
+		pod, err := r.client.CoreV1().Pods(r.namespace).Get(ctx, id, metav1.GetOptions{})
+		if err != nil {
+			return false, kubeError(err)
+		}
+		switch pod.Status.Phase {
+		case corev1.PodRunning:
+			return true, nil
+		case corev1.PodSucceeded, corev1.PodFailed:
+			return false, fmt.Errorf("pod %s has terminated: %s", id, pod.Status.Phase)
+		}
+		return false, nil
+	})
+}
+
+func (r *KubernetesRuntime) PauseContainer(ctx context.Context, id string) error {
+	return fmt.Errorf("pausing pods is not supported on Kubernetes")
+}
+
+func (r *KubernetesRuntime) UnpauseContainer(ctx context.Context, id string) error {
+	return fmt.Errorf("pausing pods is not supported on Kubernetes")
+}
+
+func (r *KubernetesRuntime) StopContainer(ctx context.Context, id string) error {
+	return fmt.Errorf("stopping pods is not supported on Kubernetes")
+}
+
+func podInfo(pod *corev1.Pod) ContainerInfo {
+	info := ContainerInfo{
+		ID:      pod.Name,
+		Name:    pod.Name,
+		Labels:  decodeKubeLabels(pod.ObjectMeta),
+		Network: make(map[string]string),
+	}
+	if len(pod.Spec.Containers) > 0 {
+		info.Image = pod.Spec.Containers[0].Image
+	}
+
+	switch pod.Status.Phase {
+	case corev1.PodRunning:
+		info.State = "running"
+	case corev1.PodSucceeded, corev1.PodFailed:
+		info.State = "exited"
+	default:
+		info.State = "created"
+	}
+	if pod.DeletionTimestamp != nil {
+		info.State = "removing"
+	}
+
+	// all pods share the cluster network
+	info.Network["pod"] = pod.Status.PodIP
+	return info
+}
+
+func (r *KubernetesRuntime) InspectContainer(ctx context.Context, id string) (ContainerInfo, error) {
+	pod, err := r.client.CoreV1().Pods(r.namespace).Get(ctx, id, metav1.GetOptions{})
+	if err != nil {
+		return ContainerInfo{}, kubeError(err)
+	}
+	return podInfo(pod), nil
+}
+
+// ContainerStats is not supported, the metrics API is not part of the core API
+func (r *KubernetesRuntime) ContainerStats(ctx context.Context, id string) (ContainerStats, error) {
+	return ContainerStats{}, fmt.Errorf("container stats are not supported on Kubernetes")
+}
+
+func (r *KubernetesRuntime) ListContainers(ctx context.Context, labels map[string]string) ([]ContainerInfo, error) {
+	pods, err := r.client.CoreV1().Pods(r.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: kubeSelector(labels),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]ContainerInfo, 0, len(pods.Items))
+	for i := range pods.Items {
+		result = append(result, podInfo(&pods.Items[i]))
+	}
+	return result, nil
+}
+
+func (r *KubernetesRuntime) RemoveContainer(ctx context.Context, id string) error {
+	grace := int64(5)
+	return kubeError(r.client.CoreV1().Pods(r.namespace).Delete(ctx, id, metav1.DeleteOptions{
+		GracePeriodSeconds: &grace,
+	}))
+}
+
+func (r *KubernetesRuntime) RenameContainer(ctx context.Context, id, name string) error {
+	return fmt.Errorf("renaming pods is not supported on Kubernetes")
+}
+
+// CreateNetwork is not supported, pods are isolated with NetworkPolicies instead
+func (r *KubernetesRuntime) CreateNetwork(ctx context.Context, spec NetworkSpec) (bool, error) {
+	return false, fmt.Errorf("networks are not supported on Kubernetes, use NetworkPolicies")
+}
+
+func (r *KubernetesRuntime) RemoveNetwork(ctx context.Context, name string) error {
+	return fmt.Errorf("networks are not supported on Kubernetes, use NetworkPolicies")
+}
+
+// ConnectNetwork is not needed, all pods are reachable in the cluster network
+func (r *KubernetesRuntime) ConnectNetwork(ctx context.Context, network, id string, aliases []string) error {
+	return nil
+}
+
+func (r *KubernetesRuntime) DisconnectNetwork(ctx context.Context, network, id string) error {
+	return nil
+}
+
+func (r *KubernetesRuntime) AttachContainer(ctx context.Context, id string) (Stream, error) {
+	req := r.client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(r.namespace).
+		Name(id).
+		SubResource("attach").
+		VersionedParams(&corev1.PodAttachOptions{
+			Container: kubeContainerName,
+			Stdin:     true,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	return r.stream(id, req.URL(), false)
+}
+
+func (r *KubernetesRuntime) ResizeContainer(ctx context.Context, id string, height, width uint) error {
+	return r.resize(id, height, width)
+}
+
+// Events watches the pods. Restarts of the workspace container are reported as
+// die, with an oom before if it was killed for running out of memory.
+func (r *KubernetesRuntime) Events(ctx context.Context, labels map[string]string) (<-chan ContainerEvent, <-chan error) {
+	result := make(chan ContainerEvent)
+	errs := make(chan error, 1)
+
+	watcher, err := r.client.CoreV1().Pods(r.namespace).Watch(ctx, metav1.ListOptions{
+		LabelSelector: kubeSelector(labels),
+	})
+	if err != nil {
+		errs <- err
+		return result, errs
+	}
+
+	go func() {
+		defer watcher.Stop()
+		restarts := make(map[string]int32)
+
+		send := func(events ...ContainerEvent) bool {
+			for _, event := range events {
+				select {
+				case result <- event:
+				case <-ctx.Done():
+					return false
+				}
+			}
+			return true
+		}
+
+		for {
+			var event watch.Event
+			var ok bool
+			select {
+			case event, ok = <-watcher.ResultChan():
+			case <-ctx.Done():
+				return
+			}
+			if !ok {
+				errs <- fmt.Errorf("pod watch closed")
+				return
+			}
+
+			pod, isPod := event.Object.(*corev1.Pod)
+			if !isPod {
+				if event.Type == watch.Error {
+					errs <- kubeError(apierrors.FromObject(event.Object))
+					return
+				}
+				continue
+			}
+
+			if event.Type == watch.Deleted {
+				delete(restarts, pod.Name)
+				if !send(ContainerEvent{ID: pod.Name, Action: "destroy"}) {
+					return
+				}
+				continue
+			}
+
+			for _, status := range pod.Status.ContainerStatuses {
+				if status.Name != kubeContainerName {
+					continue
+				}
+				previous, seen := restarts[pod.Name]
+				restarts[pod.Name] = status.RestartCount
+				terminated := status.LastTerminationState.Terminated
+				if !seen || status.RestartCount <= previous || terminated == nil {
+					continue
+				}
+
+				var events []ContainerEvent
+				if terminated.Reason == "OOMKilled" {
+					events = append(events, ContainerEvent{ID: pod.Name, Action: "oom"})
+				}
+				events = append(events, ContainerEvent{ID: pod.Name, Action: "die", ExitCode: int(terminated.ExitCode)})
+				if !send(events...) {
+					return
+				}
+			}
+		}
+	}()
+	return result, errs
+}
+
+// Exec runs the command in the workspace container. The exec API has no
+// options for the user, the environment and the working directory, so the
+// command is wrapped with runuser, env and sh. Commands run as the user of the
+// image, which has to be root to switch to another user. The exec fails if the
+// user cannot be switched.
+func (r *KubernetesRuntime) Exec(ctx context.Context, id string, spec ExecSpec) (Stream, string, error) {
+	cmd := spec.Cmd
+	if spec.WorkingDir != "" {
+		cmd = append([]string{"/bin/sh", "-c", `cd "$0" 2>/dev/null; exec "$@"`, spec.WorkingDir}, cmd...)
+	}
+	if len(spec.Env) > 0 {
+		cmd = append(append([]string{"env"}, spec.Env...), cmd...)
+	}
+	if spec.User != "" {
+		if strings.Contains(spec.User, ":") {
+			return nil, "", fmt.Errorf("failed to create exec: user with group %s is not supported on Kubernetes", spec.User)
+		}
+		// runuser resets the environment, env runs after it
+		cmd = append([]string{"/bin/sh", "-c", kubeSwitchUser, spec.User}, cmd...)
+	}
+
+	req := r.client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(r.namespace).
+		Name(id).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: kubeContainerName,
+			Command:   cmd,
+			Stdin:     true,
+			Stdout:    true,
+			Stderr:    !spec.Tty,
+			TTY:       spec.Tty,
+		}, scheme.ParameterCodec)
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, "", fmt.Errorf("failed to generate exec ID: %w", err)
+	}
+	execID := hex.EncodeToString(buf)
+	stream, err := r.stream(execID, req.URL(), spec.Tty)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create exec: %w", err)
+	}
+	return stream, execID, nil
+}
+
+// ExecExitCode returns 0, a failed command ends the exec stream with an exit error
+func (r *KubernetesRuntime) ExecExitCode(ctx context.Context, execID string) (int, error) {
+	return 0, nil
+}
+
+func (r *KubernetesRuntime) ResizeExec(ctx context.Context, execID string, height, width uint) error {
+	return r.resize(execID, height, width)
+}
+
+// stream starts the executor in the background and pipes stdin and stdout.
+// Without a TTY, stdout and stderr are multiplexed like Docker streams.
+func (r *KubernetesRuntime) stream(id string, u *url.URL, tty bool) (Stream, error) {
+	executor, err := r.newExecutor("POST", u)
+	if err != nil {
+		return nil, err
+	}
+
+	stdinReader, stdinWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	queue := &kubeSizeQueue{
+		sizes: make(chan remotecommand.TerminalSize, 1),
+		done:  ctx.Done(),
+	}
+	r.sizeQueuesMutex.Lock()
+	r.sizeQueues[id] = queue
+	r.sizeQueuesMutex.Unlock()
+
+	options := remotecommand.StreamOptions{
+		Stdin: stdinReader,
+		Tty:   tty,
+	}
+	if tty {
+		options.Stdout = outWriter
+		options.TerminalSizeQueue = queue
+	} else {
+		options.Stdout = stdcopy.NewStdWriter(outWriter, stdcopy.Stdout)
+		options.Stderr = stdcopy.NewStdWriter(outWriter, stdcopy.Stderr)
+	}
+
+	go func() {
+		err := executor.StreamWithContext(ctx, options)
+		outWriter.CloseWithError(err)
+		stdinReader.Close()
+
+		r.sizeQueuesMutex.Lock()
+		if r.sizeQueues[id] == queue {
+			delete(r.sizeQueues, id)
+		}
+		r.sizeQueuesMutex.Unlock()
+	}()
+
+	return &kubeStream{stdin: stdinWriter, out: outReader, cancel: cancel}, nil
+}
+
+func (r *KubernetesRuntime) resize(id string, height, width uint) error {
+	r.sizeQueuesMutex.Lock()
+	queue, exists := r.sizeQueues[id]
+	r.sizeQueuesMutex.Unlock()
+	if !exists {
+		return fmt.Errorf("%w: no stream %s", ErrNotFound, id)
+	}
+	queue.push(remotecommand.TerminalSize{Height: uint16(height), Width: uint16(width)})
+	return nil
+}
+
+// CreateVolume creates a persistent volume claim requesting the quota as storage.
+// An existing claim is kept, it holds the workspace data.
+func (r *KubernetesRuntime) CreateVolume(ctx context.Context, spec VolumeSpec) error {
+	labels, annotations := kubeLabels(spec.Labels)
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        kubeName(spec.Name),
+			Namespace:   r.namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: *resource.NewQuantity(spec.SizeBytes, resource.BinarySI),
+				},
+			},
+		},
+	}
+	if r.storageClass != "" {
+		pvc.Spec.StorageClassName = &r.storageClass
+	}
+
+	_, err := r.client.CoreV1().PersistentVolumeClaims(r.namespace).Create(ctx, pvc, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+func (r *KubernetesRuntime) VolumeExists(ctx context.Context, name string) (bool, error) {
+	_, err := r.client.CoreV1().PersistentVolumeClaims(r.namespace).Get(ctx, kubeName(name), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *KubernetesRuntime) RemoveVolume(ctx context.Context, name string) error {
+	return kubeError(r.client.CoreV1().PersistentVolumeClaims(r.namespace).Delete(ctx, kubeName(name), metav1.DeleteOptions{}))
+}
+
+func (r *KubernetesRuntime) ListVolumes(ctx context.Context, labels map[string]string) ([]VolumeInfo, error) {
+	pvcs, err := r.client.CoreV1().PersistentVolumeClaims(r.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: kubeSelector(labels),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]VolumeInfo, 0, len(pvcs.Items))
+	for _, pvc := range pvcs.Items {
+		result = append(result, VolumeInfo{Name: pvc.Name, Labels: decodeKubeLabels(pvc.ObjectMeta)})
+	}
+	return result, nil
+}
+
+// kubeSizeQueue hands terminal sizes to the executor, only the latest size is kept
+type kubeSizeQueue struct {
+	sizes chan remotecommand.TerminalSize
+	done  <-chan struct{}
+}
+
+func (q *kubeSizeQueue) Next() *remotecommand.TerminalSize {
+	select {
+	case size := <-q.sizes:
+		return &size
+	case <-q.done:
+		return nil
+	}
+}
+
+func (q *kubeSizeQueue) push(size remotecommand.TerminalSize) {
+	for {
+		select {
+		case q.sizes <- size:
+			return
+		default:
+		}
+		// drop the outdated size
+		select {
+		case <-q.sizes:
+		default:
+		}
+	}
+}
+
+// kubeStream adapts the pipes of an executor to the Stream interface
+type kubeStream struct {
+	stdin  *io.PipeWriter
+	out    *io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (s *kubeStream) Read(p []byte) (int, error) {
+	return s.out.Read(p)
+}
+
+func (s *kubeStream) Write(p []byte) (int, error) {
+	return s.stdin.Write(p)
+}
+
+func (s *kubeStream) CloseWrite() error {
+	return s.stdin.Close()
+}
+
+func (s *kubeStream) Close() error {
+	s.cancel()
+	s.stdin.Close()
+	return s.out.Close()
+}
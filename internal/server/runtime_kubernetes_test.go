@@ -0,0 +1,290 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// fakeKubeClient is a fake clientset with a REST client for the exec URLs, the
+// fake CoreV1 client has none
+type fakeKubeClient struct {
+	*fake.Clientset
+	rest rest.Interface
+}
+
+func (c fakeKubeClient) CoreV1() corev1client.CoreV1Interface {
+	return fakeCoreV1{CoreV1Interface: c.Clientset.CoreV1(), rest: c.rest}
+}
+
+type fakeCoreV1 struct {
+	corev1client.CoreV1Interface
+	rest rest.Interface
+}
+
+func (c fakeCoreV1) RESTClient() rest.Interface {
+	return c.rest
+}
+
+// fakeExecServer runs the commands of exec requests on the local machine, like
+// the kubelet runs them in the container
+type fakeExecServer struct {
+	mutex    sync.Mutex
+	requests []*url.URL
+}
+
+func (s *fakeExecServer) executor(method string, u *url.URL) (remotecommand.Executor, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests = append(s.requests, u)
+	return fakeExecutor{url: u}, nil
+}
+
+type fakeExecutor struct {
+	url *url.URL
+}
+
+func (e fakeExecutor) Stream(options remotecommand.StreamOptions) error {
+	return e.StreamWithContext(context.Background(), options)
+}
+
+func (e fakeExecutor) StreamWithContext(ctx context.Context, options remotecommand.StreamOptions) error {
+	command := e.url.Query()["command"]
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = options.Stdin
+	cmd.Stdout = options.Stdout
+	cmd.Stderr = options.Stderr
+	return cmd.Run()
+}
+
+func newFakeKubernetesRuntime(t *testing.T) (*KubernetesRuntime, *fakeExecServer) {
+	t.Helper()
+	restClient, err := rest.RESTClientFor(&rest.Config{
+		Host:    "https://kubernetes.invalid",
+		APIPath: "/api",
+		ContentConfig: rest.ContentConfig{
+			GroupVersion:         &corev1.SchemeGroupVersion,
+			NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeExecServer{}
+	client := fakeKubeClient{Clientset: fake.NewSimpleClientset(), rest: restClient}
+	return NewKubernetesRuntimeWithClient(client, "workspaces", "", server.executor), server
+}
+
+// runExec runs the exec without stdin and returns its stdout and stderr
+func runExec(t *testing.T, r *KubernetesRuntime, spec ExecSpec) (string, error) {
+	t.Helper()
+	stream, _, err := r.Exec(context.Background(), "sshcontainer-alice", spec)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+	stream.CloseWrite()
+
+	var output bytes.Buffer
+	_, err = stdcopy.StdCopy(&output, &output, stream)
+	return output.String(), err
+}
+
+func TestKubernetesContainerLifecycle(t *testing.T) {
+	r, _ := newFakeKubernetesRuntime(t)
+	ctx := context.Background()
+
+	labels := map[string]string{managedLabel: "true", "de.mc8051.sshcontainer.user": "alice"}
+	id, err := r.CreateContainer(ctx, ContainerSpec{
+		Name:   "sshcontainer-alice",
+		Image:  "ubuntu:22.04",
+		Cmd:    []string{"sleep", "infinity"},
+		Env:    []string{"CREATING_USER=alice"},
+		Labels: labels,
+		Mounts: []Mount{{Type: MountVolume, Source: "sshcontainer-alice", Target: "/workspace"}},
+	})
+	if err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+
+	pod, err := r.client.CoreV1().Pods("workspaces").Get(ctx, id, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("pod not created: %v", err)
+	}
+	container := pod.Spec.Containers[0]
+	if container.Name != kubeContainerName || container.Image != "ubuntu:22.04" {
+		t.Errorf("container = %s running %s", container.Name, container.Image)
+	}
+	if claim := pod.Spec.Volumes[0].PersistentVolumeClaim; claim == nil || claim.ClaimName != "sshcontainer-alice" {
+		t.Errorf("volume = %+v, want the claim sshcontainer-alice", pod.Spec.Volumes[0])
+	}
+
+	containers, err := r.ListContainers(ctx, labels)
+	if err != nil {
+		t.Fatalf("ListContainers: %v", err)
+	}
+	if len(containers) != 1 || containers[0].ID != id || containers[0].State != "created" {
+		t.Errorf("ListContainers = %+v", containers)
+	}
+
+	if err := r.RemoveContainer(ctx, id); err != nil {
+		t.Fatalf("RemoveContainer: %v", err)
+	}
+	if _, err := r.InspectContainer(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("InspectContainer after remove = %v, want ErrNotFound", err)
+	}
+}
+
+// Usernames may end with a dot or an underscore and be longer than label
+// values, the runtime encodes them and returns the raw labels
+func TestKubernetesLabelValues(t *testing.T) {
+	r, _ := newFakeKubernetesRuntime(t)
+	ctx := context.Background()
+
+	for _, username := range []string{"alice.", "bob_", strings.Repeat("c", 70)} {
+		ws := Workspace{User: username, Name: "dev"}
+		labels := map[string]string{
+			managedLabel:                       "true",
+			"de.mc8051.sshcontainer.user":      ws.User,
+			"de.mc8051.sshcontainer.workspace": ws.Name,
+		}
+		id, err := r.CreateContainer(ctx, ContainerSpec{Name: ws.ContainerName(""), Image: "ubuntu:22.04", Labels: labels})
+		if err != nil {
+			t.Fatalf("CreateContainer for %s: %v", username, err)
+		}
+		if err := r.CreateVolume(ctx, VolumeSpec{Name: ws.VolumeName(""), Labels: labels, SizeBytes: 1 << 30}); err != nil {
+			t.Fatalf("CreateVolume for %s: %v", username, err)
+		}
+
+		pod, err := r.client.CoreV1().Pods("workspaces").Get(ctx, id, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range pod.Labels {
+			if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+				t.Errorf("label %s=%q of %s: %v", key, value, username, errs)
+			}
+		}
+
+		containers, err := r.ListContainers(ctx, labels)
+		if err != nil {
+			t.Fatalf("ListContainers: %v", err)
+		}
+		if len(containers) != 1 || containers[0].ID != id {
+			t.Fatalf("ListContainers for %s = %+v", username, containers)
+		}
+		if got := WorkspaceFromLabels(containers[0].Labels); got != ws {
+			t.Errorf("WorkspaceFromLabels = %+v, want %+v", got, ws)
+		}
+
+		volumes, err := r.ListVolumes(ctx, labels)
+		if err != nil {
+			t.Fatalf("ListVolumes: %v", err)
+		}
+		if len(volumes) != 1 || WorkspaceFromLabels(volumes[0].Labels) != ws {
+			t.Errorf("ListVolumes for %s = %+v", username, volumes)
+		}
+	}
+}
+
+func TestKubernetesExecRequest(t *testing.T) {
+	r, server := newFakeKubernetesRuntime(t)
+
+	if _, err := runExec(t, r, ExecSpec{Cmd: []string{"true"}}); err != nil {
+		t.Fatalf("exec: %v", err)
+	}
+
+	u := server.requests[0]
+	if want := "/api/v1/namespaces/workspaces/pods/sshcontainer-alice/exec"; u.Path != want {
+		t.Errorf("exec path = %s, want %s", u.Path, want)
+	}
+	query := u.Query()
+	if query.Get("container") != kubeContainerName || query.Get("stdin") != "true" || query.Get("stderr") != "true" {
+		t.Errorf("exec options = %s", u.RawQuery)
+	}
+}
+
+func TestKubernetesExecEnvAndWorkingDir(t *testing.T) {
+	r, _ := newFakeKubernetesRuntime(t)
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	dir := t.TempDir()
+
+	output, err := runExec(t, r, ExecSpec{
+		Cmd:        []string{"/bin/sh", "-c", `echo "$GREETING"; pwd; id -un`},
+		Env:        []string{"GREETING=hello world"},
+		User:       current.Username,
+		WorkingDir: dir,
+	})
+	if err != nil {
+		t.Fatalf("exec: %v: %s", err, output)
+	}
+	if want := "hello world\n" + dir + "\n" + current.Username + "\n"; output != want {
+		t.Errorf("output = %q, want %q", output, want)
+	}
+}
+
+func TestKubernetesExecSwitchesUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("switching users needs root")
+	}
+	if _, err := exec.LookPath("runuser"); err != nil {
+		t.Skip("runuser is not installed")
+	}
+	r, _ := newFakeKubernetesRuntime(t)
+
+	// the environment is set after switching, runuser would reset HOME
+	output, err := runExec(t, r, ExecSpec{
+		Cmd:  []string{"/bin/sh", "-c", `id -un; echo "$HOME"`},
+		Env:  []string{"HOME=/workspace"},
+		User: "nobody",
+	})
+	if err != nil {
+		t.Fatalf("exec: %v: %s", err, output)
+	}
+	if output != "nobody\n/workspace\n" {
+		t.Errorf("output = %q, want the command to run as nobody", output)
+	}
+}
+
+func TestKubernetesExecFailsForUnknownUser(t *testing.T) {
+	r, _ := newFakeKubernetesRuntime(t)
+
+	output, err := runExec(t, r, ExecSpec{Cmd: []string{"id", "-un"}, User: "sshcontainer-nobody"})
+	if err == nil {
+		t.Fatalf("exec succeeded with output %q, want an error", output)
+	}
+	if strings.TrimSpace(output) == "root" {
+		t.Errorf("command ran as root")
+	}
+}
+
+func TestKubernetesExecRejectsGroup(t *testing.T) {
+	r, server := newFakeKubernetesRuntime(t)
+
+	if _, err := runExec(t, r, ExecSpec{Cmd: []string{"id"}, User: "1000:1000"}); err == nil {
+		t.Fatal("exec with a group succeeded")
+	}
+	if len(server.requests) > 0 {
+		t.Errorf("exec was sent: %s", server.requests[0])
+	}
+}
@@ -0,0 +1,840 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const podmanAPIPrefix = "/v4.0.0/libpod"
+
+// PodmanRuntime runs user containers on the libpod REST API of a Podman socket
+type PodmanRuntime struct {
+	socket     string
+	seccompDir string // directory of the seccomp profiles on the podman host
+	client     *http.Client
+}
+
+func NewPodmanRuntime(socket, seccompDir string) (*PodmanRuntime, error) {
+	r := &PodmanRuntime{
+		socket:     socket,
+		seccompDir: seccompDir,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+
+	if err := r.do(context.Background(), http.MethodGet, "/_ping", nil, nil, nil); err != nil {
+		return nil, fmt.Errorf("failed to connect to podman socket %s: %w", socket, err)
+	}
+	return r, nil
+}
+
+func (r *PodmanRuntime) Name() string {
+	return "podman"
+}
+
+func (r *PodmanRuntime) Info(ctx context.Context) (RuntimeInfo, error) {
+	var info struct {
+		Host struct {
+			Security struct {
+				Rootless bool `json:"rootless"`
+			} `json:"security"`
+		} `json:"host"`
+	}
+	if err := r.do(ctx, http.MethodGet, "/info", nil, nil, &info); err != nil {
+		return RuntimeInfo{}, fmt.Errorf("failed to get podman info: %w", err)
+	}
+	if !info.Host.Security.Rootless {
+		return RuntimeInfo{}, nil
+	}
+
+	uid, gid, err := socketOwner(r.socket)
+	if err != nil {
+		return RuntimeInfo{}, err
+	}
+	return RuntimeInfo{Rootless: true, UID: uid, GID: gid}, nil
+}
+
+func (r *PodmanRuntime) newRequest(ctx context.Context, method, path string, query url.Values, body any) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	u := "http://podman" + podmanAPIPrefix + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// podmanResponseError converts an error response of the libpod API
+func podmanResponseError(resp *http.Response) error {
+	var apiErr struct {
+		Message string `json:"message"`
+	}
+	data, _ := io.ReadAll(resp.Body)
+	if json.Unmarshal(data, &apiErr) != nil || apiErr.Message == "" {
+		apiErr.Message = strings.TrimSpace(string(data))
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrNotFound, apiErr.Message)
+	}
+	return fmt.Errorf("podman API error (%d): %s", resp.StatusCode, apiErr.Message)
+}
+
+// do performs a request and decodes the JSON response into out if it is not nil
+func (r *PodmanRuntime) do(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	req, err := r.newRequest(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return podmanResponseError(resp)
+	}
+
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// exists calls one of the libpod exists endpoints which answer with 204 or 404
+func (r *PodmanRuntime) exists(ctx context.Context, path string) (bool, error) {
+	err := r.do(ctx, http.MethodGet, path, nil, nil, nil)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return false, err
+}
+
+// hijack performs a request that upgrades the connection to a raw stream
+func (r *PodmanRuntime) hijack(ctx context.Context, path string, query url.Values, body any) (Stream, error) {
+	req, err := r.newRequest(ctx, http.MethodPost, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", r.socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to podman socket: %w", err)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		defer conn.Close()
+		return nil, podmanResponseError(resp)
+	}
+
+	return &podmanStream{conn: conn, reader: reader}, nil
+}
+
+func (r *PodmanRuntime) PullImage(ctx context.Context, ref string, auth *RegistryAuth) error {
+	req, err := r.newRequest(ctx, http.MethodPost, "/images/pull", url.Values{
+		"reference": {ref},
+		"quiet":     {"true"},
+	}, nil)
+	if err != nil {
+		return err
+	}
+	if auth != nil {
+		encoded, err := auth.Encode()
+		if err != nil {
+			return fmt.Errorf("failed to encode registry auth: %w", err)
+		}
+		req.Header.Set("X-Registry-Auth", encoded)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return podmanResponseError(resp)
+	}
+
+	// the pull reports errors in its progress stream
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var report struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&report); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read pull progress: %w", err)
+		}
+		if report.Error != "" {
+			return fmt.Errorf("failed to pull image: %s", report.Error)
+		}
+	}
+}
+
+func (r *PodmanRuntime) ImageExists(ctx context.Context, ref string) (bool, error) {
+	return r.exists(ctx, "/images/"+ref+"/exists")
+}
+
+func (r *PodmanRuntime) InspectImage(ctx context.Context, ref string) (ImageInfo, error) {
+	var img struct {
+		ID          string   `json:"Id"`
+		RepoTags    []string `json:"RepoTags"`
+		RepoDigests []string `json:"RepoDigests"`
+		Config      struct {
+			User       string            `json:"User"`
+			WorkingDir string            `json:"WorkingDir"`
+			Labels     map[string]string `json:"Labels"`
+		} `json:"Config"`
+	}
+	if err := r.do(ctx, http.MethodGet, "/images/"+ref+"/json", nil, nil, &img); err != nil {
+		return ImageInfo{}, err
+	}
+
+	return ImageInfo{
+		ID:          img.ID,
+		RepoTags:    img.RepoTags,
+		RepoDigests: img.RepoDigests,
+		Labels:      img.Config.Labels,
+		User:        img.Config.User,
+		WorkingDir:  img.Config.WorkingDir,
+	}, nil
+}
+
+// podmanSpec is the subset of the libpod SpecGenerator used for user containers
+type podmanSpec struct {
+	Name            string                       `json:"name"`
+	Image           string                       `json:"image"`
+	Command         []string                     `json:"command,omitempty"`
+	Env             map[string]string            `json:"env,omitempty"`
+	Labels          map[string]string            `json:"labels,omitempty"`
+	Stdin           bool                         `json:"stdin"`
+	Mounts          []podmanMount                `json:"mounts,omitempty"`
+	Volumes         []podmanNamedVolume          `json:"volumes,omitempty"`
+	Networks        map[string]map[string]string `json:"Networks,omitempty"`
+	NetNS           *podmanNamespace             `json:"netns,omitempty"`
+	DNSServers      []string                     `json:"dns_server,omitempty"`
+	UserNS          *podmanNamespace             `json:"userns,omitempty"`
+	IDMappings      *podmanIDMappings            `json:"idmappings,omitempty"`
+	CapAdd          []string                     `json:"cap_add,omitempty"`
+	Devices         []map[string]string          `json:"devices,omitempty"`
+	ReadOnly        bool                         `json:"read_only_filesystem"`
+	NoNewPrivileges bool                         `json:"no_new_privileges,omitempty"`
+	SeccompProfile  string                       `json:"seccomp_profile_path,omitempty"`
+	ApparmorProfile string                       `json:"apparmor_profile,omitempty"`
+	SelinuxOpts     []string                     `json:"selinux_opts,omitempty"`
+	ResourceLimits  *podmanResources             `json:"resource_limits,omitempty"`
+	Rlimits         []podmanRlimit               `json:"r_limits,omitempty"`
+	OomScoreAdj     *int                         `json:"oom_score_adj,omitempty"`
+
+	ThrottleReadBpsDevice   map[string]podmanThrottle `json:"throttleReadBpsDevice,omitempty"`
+	ThrottleWriteBpsDevice  map[string]podmanThrottle `json:"throttleWriteBpsDevice,omitempty"`
+	ThrottleReadIOPSDevice  map[string]podmanThrottle `json:"throttleReadIOPSDevice,omitempty"`
+	ThrottleWriteIOPSDevice map[string]podmanThrottle `json:"throttleWriteIOPSDevice,omitempty"`
+}
+
+type podmanThrottle struct {
+	Rate uint64 `json:"rate"`
+}
+
+type podmanRlimit struct {
+	Type string `json:"type"`
+	Hard int64  `json:"hard"`
+	Soft int64  `json:"soft"`
+}
+
+type podmanMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+type podmanNamedVolume struct {
+	Name    string   `json:"Name"`
+	Dest    string   `json:"Dest"`
+	Options []string `json:"Options,omitempty"`
+}
+
+// podmanIDMappings are the storage IDMappingOptions, the fields have no JSON tags
+type podmanIDMappings struct {
+	UIDMap []podmanIDMap `json:"UIDMap"`
+	GIDMap []podmanIDMap `json:"GIDMap"`
+}
+
+type podmanIDMap struct {
+	ContainerID int64 `json:"container_id"`
+	HostID      int64 `json:"host_id"`
+	Size        int64 `json:"size"`
+}
+
+type podmanNamespace struct {
+	NSMode string `json:"nsmode"`
+	Value  string `json:"value,omitempty"`
+}
+
+type podmanResources struct {
+	Memory  *podmanMemory  `json:"memory,omitempty"`
+	CPU     *podmanCPU     `json:"cpu,omitempty"`
+	Pids    *podmanPids    `json:"pids,omitempty"`
+	BlockIO *podmanBlockIO `json:"blockIO,omitempty"`
+}
+
+type podmanMemory struct {
+	Limit int64 `json:"limit,omitempty"`
+	Swap  int64 `json:"swap,omitempty"`
+}
+
+type podmanCPU struct {
+	Quota  int64  `json:"quota"`
+	Period uint64 `json:"period"`
+}
+
+type podmanPids struct {
+	Limit int64 `json:"limit"`
+}
+
+type podmanBlockIO struct {
+	Weight uint16 `json:"weight,omitempty"`
+}
+
+func (r *PodmanRuntime) CreateContainer(ctx context.Context, spec ContainerSpec) (string, error) {
+	s := podmanSpec{
+		Name:       spec.Name,
+		Image:      spec.Image,
+		Command:    spec.Cmd,
+		Env:        make(map[string]string),
+		Labels:     spec.Labels,
+		Stdin:      true,
+		DNSServers: spec.DNS,
+		CapAdd:     spec.CapAdd,
+		ReadOnly:   spec.ReadOnly,
+	}
+
+	for _, env := range spec.Env {
+		k, v, _ := strings.Cut(env, "=")
+		s.Env[k] = v
+	}
+
+	for _, m := range spec.Mounts {
+		switch m.Type {
+		case MountVolume:
+			volume := podmanNamedVolume{Name: m.Source, Dest: m.Target}
+			if m.ReadOnly {
+				volume.Options = []string{"ro"}
+			}
+			s.Volumes = append(s.Volumes, volume)
+		case MountBind:
+			options := []string{"rbind"}
+			if m.ReadOnly {
+				options = append(options, "ro")
+			}
+			if m.Propagation != "" {
+				options = append(options, m.Propagation)
+			}
+			s.Mounts = append(s.Mounts, podmanMount{Destination: m.Target, Type: "bind", Source: m.Source, Options: options})
+		case MountTmpfs:
+			options := []string{fmt.Sprintf("mode=%o", m.Mode.Perm())}
+			if m.SizeBytes > 0 {
+				options = append(options, fmt.Sprintf("size=%d", m.SizeBytes))
+			}
+			s.Mounts = append(s.Mounts, podmanMount{Destination: m.Target, Type: "tmpfs", Source: "tmpfs", Options: options})
+		}
+	}
+
+	if len(spec.Networks) > 0 {
+		s.Networks = map[string]map[string]string{spec.Networks[0]: {}}
+	} else if spec.NetworkMode != "" {
+		s.NetNS = &podmanNamespace{NSMode: spec.NetworkMode}
+	}
+
+	if spec.IDMapping != nil {
+		idMap := []podmanIDMap{{ContainerID: 0, HostID: spec.IDMapping.HostID, Size: spec.IDMapping.Size}}
+		s.UserNS = &podmanNamespace{NSMode: "private"}
+		s.IDMappings = &podmanIDMappings{UIDMap: idMap, GIDMap: idMap}
+	} else if spec.UsernsMode != "" {
+		mode, value, _ := strings.Cut(spec.UsernsMode, ":")
+		s.UserNS = &podmanNamespace{NSMode: mode, Value: value}
+	}
+
+	for _, dev := range spec.Devices {
+		s.Devices = append(s.Devices, map[string]string{"path": dev})
+	}
+
+	if spec.Security.Seccomp != nil {
+		s.SeccompProfile = path.Join(r.seccompDir, spec.Security.Name+".json")
+	}
+	s.ApparmorProfile = spec.Security.AppArmor
+	for _, opt := range spec.SecurityOpt {
+		key, value, _ := strings.Cut(opt, "=")
+		if k, v, ok := strings.Cut(opt, ":"); ok && key == opt {
+			key, value = k, v
+		}
+		switch key {
+		case "no-new-privileges":
+			s.NoNewPrivileges = value == "" || value == "true"
+		case "seccomp":
+			s.SeccompProfile = value
+		case "apparmor":
+			s.ApparmorProfile = value
+		case "label":
+			s.SelinuxOpts = append(s.SelinuxOpts, value)
+		default:
+			return "", fmt.Errorf("unsupported security option for podman: %s", opt)
+		}
+	}
+
+	res := spec.Resources
+	s.ResourceLimits = &podmanResources{}
+	if res.MemoryBytes > 0 || res.MemorySwapBytes != 0 {
+		s.ResourceLimits.Memory = &podmanMemory{Limit: res.MemoryBytes, Swap: res.MemorySwapBytes}
+	}
+	if res.NanoCPUs > 0 {
+		const period = 100000
+		s.ResourceLimits.CPU = &podmanCPU{Quota: res.NanoCPUs * period / 1e9, Period: period}
+	}
+	if res.PidsLimit > 0 {
+		s.ResourceLimits.Pids = &podmanPids{Limit: res.PidsLimit}
+	}
+	if res.BlkioWeight > 0 {
+		s.ResourceLimits.BlockIO = &podmanBlockIO{Weight: res.BlkioWeight}
+	}
+	if res.OomScoreAdj != 0 {
+		s.OomScoreAdj = &res.OomScoreAdj
+	}
+	throttle := func(devices []ThrottleDevice) map[string]podmanThrottle {
+		if len(devices) == 0 {
+			return nil
+		}
+		result := make(map[string]podmanThrottle, len(devices))
+		for _, d := range devices {
+			result[d.Path] = podmanThrottle{Rate: d.Rate}
+		}
+		return result
+	}
+	s.ThrottleReadBpsDevice = throttle(res.DeviceReadBps)
+	s.ThrottleWriteBpsDevice = throttle(res.DeviceWriteBps)
+	s.ThrottleReadIOPSDevice = throttle(res.DeviceReadIops)
+	s.ThrottleWriteIOPSDevice = throttle(res.DeviceWriteIops)
+	for _, u := range res.Ulimits {
+		s.Rlimits = append(s.Rlimits, podmanRlimit{
+			Type: "RLIMIT_" + strings.ToUpper(u.Name),
+			Hard: u.Hard,
+			Soft: u.Soft,
+		})
+	}
+
+	var resp struct {
+		ID string `json:"Id"`
+	}
+	if err := r.do(ctx, http.MethodPost, "/containers/create", nil, s, &resp); err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+func (r *PodmanRuntime) StartContainer(ctx context.Context, id string) error {
+	return r.do(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil, nil)
+}
+
+func (r *PodmanRuntime) PauseContainer(ctx context.Context, id string) error {
+	return r.do(ctx, http.MethodPost, "/containers/"+id+"/pause", nil, nil, nil)
+}
+
+func (r *PodmanRuntime) UnpauseContainer(ctx context.Context, id string) error {
+	return r.do(ctx, http.MethodPost, "/containers/"+id+"/unpause", nil, nil, nil)
+}
+
+func (r *PodmanRuntime) StopContainer(ctx context.Context, id string) error {
+	return r.do(ctx, http.MethodPost, "/containers/"+id+"/stop", nil, nil, nil)
+}
+
+func (r *PodmanRuntime) InspectContainer(ctx context.Context, id string) (ContainerInfo, error) {
+	var ct struct {
+		ID    string `json:"Id"`
+		Name  string `json:"Name"`
+		Image string `json:"Image"`
+		State struct {
+			Status string `json:"Status"`
+		} `json:"State"`
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"Config"`
+		NetworkSettings struct {
+			Networks map[string]struct {
+				IPAddress string `json:"IPAddress"`
+			} `json:"Networks"`
+		} `json:"NetworkSettings"`
+	}
+	if err := r.do(ctx, http.MethodGet, "/containers/"+id+"/json", nil, nil, &ct); err != nil {
+		return ContainerInfo{}, err
+	}
+
+	info := ContainerInfo{
+		ID:      ct.ID,
+		Name:    ct.Name,
+		Image:   ct.Image,
+		State:   ct.State.Status,
+		Labels:  ct.Config.Labels,
+		Network: make(map[string]string),
+	}
+	for name, settings := range ct.NetworkSettings.Networks {
+		info.Network[name] = settings.IPAddress
+	}
+	return info, nil
+}
+
+func (r *PodmanRuntime) ContainerStats(ctx context.Context, id string) (ContainerStats, error) {
+	var resp struct {
+		Error any `json:"Error"`
+		Stats []struct {
+			CPU       float64 `json:"CPU"`
+			MemUsage  uint64  `json:"MemUsage"`
+			MemLimit  uint64  `json:"MemLimit"`
+			NetInput  uint64  `json:"NetInput"`
+			NetOutput uint64  `json:"NetOutput"`
+			PIDs      uint64  `json:"PIDs"`
+		} `json:"Stats"`
+	}
+	if err := r.do(ctx, http.MethodGet, "/containers/stats", url.Values{
+		"containers": {id},
+		"stream":     {"false"},
+	}, nil, &resp); err != nil {
+		return ContainerStats{}, fmt.Errorf("failed to get container stats: %w", err)
+	}
+	if resp.Error != nil {
+		return ContainerStats{}, fmt.Errorf("failed to get container stats: %v", resp.Error)
+	}
+	if len(resp.Stats) == 0 {
+		return ContainerStats{}, fmt.Errorf("%w: no stats for container %s", ErrNotFound, id)
+	}
+
+	s := resp.Stats[0]
+	return ContainerStats{
+		MemoryBytes:      s.MemUsage,
+		MemoryLimitBytes: s.MemLimit,
+		CPUPercent:       s.CPU,
+		Pids:             s.PIDs,
+		NetworkRxBytes:   s.NetInput,
+		NetworkTxBytes:   s.NetOutput,
+	}, nil
+}
+
+func (r *PodmanRuntime) ListContainers(ctx context.Context, labels map[string]string) ([]ContainerInfo, error) {
+	labelFilters := make([]string, 0, len(labels))
+	for k, v := range labels {
+		labelFilters = append(labelFilters, fmt.Sprintf("%s=%s", k, v))
+	}
+	filterJSON, err := json.Marshal(map[string][]string{"label": labelFilters})
+	if err != nil {
+		return nil, err
+	}
+
+	var containers []struct {
+		ID       string            `json:"Id"`
+		Names    []string          `json:"Names"`
+		ImageID  string            `json:"ImageID"`
+		State    string            `json:"State"`
+		Labels   map[string]string `json:"Labels"`
+		Networks []string          `json:"Networks"`
+	}
+	if err := r.do(ctx, http.MethodGet, "/containers/json", url.Values{
+		"all":     {"true"},
+		"filters": {string(filterJSON)},
+	}, nil, &containers); err != nil {
+		return nil, err
+	}
+
+	result := make([]ContainerInfo, 0, len(containers))
+	for _, c := range containers {
+		info := ContainerInfo{
+			ID:      c.ID,
+			Image:   c.ImageID,
+			State:   c.State,
+			Labels:  c.Labels,
+			Network: make(map[string]string),
+		}
+		if len(c.Names) > 0 {
+			info.Name = c.Names[0]
+		}
+		for _, name := range c.Networks {
+			info.Network[name] = ""
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+func (r *PodmanRuntime) RemoveContainer(ctx context.Context, id string) error {
+	return r.do(ctx, http.MethodDelete, "/containers/"+id, url.Values{
+		"force": {"true"},
+		"v":     {"true"},
+	}, nil, nil)
+}
+
+func (r *PodmanRuntime) RenameContainer(ctx context.Context, id, name string) error {
+	return r.do(ctx, http.MethodPost, "/containers/"+id+"/rename", url.Values{
+		"name": {name},
+	}, nil, nil)
+}
+
+func (r *PodmanRuntime) CreateNetwork(ctx context.Context, spec NetworkSpec) (bool, error) {
+	exists, err := r.exists(ctx, "/networks/"+spec.Name+"/exists")
+	if err != nil || exists {
+		return false, err
+	}
+
+	err = r.do(ctx, http.MethodPost, "/networks/create", nil, map[string]any{
+		"name":     spec.Name,
+		"driver":   "bridge",
+		"internal": spec.Internal,
+		"labels":   spec.Labels,
+	}, nil)
+	return err == nil, err
+}
+
+func (r *PodmanRuntime) RemoveNetwork(ctx context.Context, name string) error {
+	return r.do(ctx, http.MethodDelete, "/networks/"+name, nil, nil, nil)
+}
+
+func (r *PodmanRuntime) ConnectNetwork(ctx context.Context, network, id string, aliases []string) error {
+	return r.do(ctx, http.MethodPost, "/networks/"+network+"/connect", nil, map[string]any{
+		"container": id,
+		"aliases":   aliases,
+	}, nil)
+}
+
+func (r *PodmanRuntime) DisconnectNetwork(ctx context.Context, network, id string) error {
+	return r.do(ctx, http.MethodPost, "/networks/"+network+"/disconnect", nil, map[string]string{
+		"Container": id,
+	}, nil)
+}
+
+func (r *PodmanRuntime) AttachContainer(ctx context.Context, id string) (Stream, error) {
+	return r.hijack(ctx, "/containers/"+id+"/attach", url.Values{
+		"stream": {"true"},
+		"stdin":  {"true"},
+		"stdout": {"true"},
+		"stderr": {"true"},
+	}, nil)
+}
+
+func sizeQuery(height, width uint) url.Values {
+	return url.Values{
+		"h": {strconv.FormatUint(uint64(height), 10)},
+		"w": {strconv.FormatUint(uint64(width), 10)},
+	}
+}
+
+func (r *PodmanRuntime) ResizeContainer(ctx context.Context, id string, height, width uint) error {
+	return r.do(ctx, http.MethodPost, "/containers/"+id+"/resize", sizeQuery(height, width), nil, nil)
+}
+
+// podmanActions maps libpod event names to the Docker names
+var podmanActions = map[string]string{
+	"died":   "die",
+	"remove": "destroy",
+}
+
+func (r *PodmanRuntime) Events(ctx context.Context, labels map[string]string) (<-chan ContainerEvent, <-chan error) {
+	result := make(chan ContainerEvent)
+	errs := make(chan error, 1)
+
+	labelFilters := make([]string, 0, len(labels))
+	for k, v := range labels {
+		labelFilters = append(labelFilters, fmt.Sprintf("%s=%s", k, v))
+	}
+	filters, _ := json.Marshal(map[string][]string{
+		"type":  {"container"},
+		"label": labelFilters,
+	})
+
+	req, err := r.newRequest(ctx, http.MethodGet, "/events", url.Values{
+		"stream":  {"true"},
+		"filters": {string(filters)},
+	}, nil)
+	if err != nil {
+		errs <- err
+		return result, errs
+	}
+
+	go func() {
+		resp, err := r.client.Do(req)
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			errs <- podmanResponseError(resp)
+			return
+		}
+
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var msg struct {
+				Action string `json:"Action"`
+				Actor  struct {
+					ID         string            `json:"ID"`
+					Attributes map[string]string `json:"Attributes"`
+				} `json:"Actor"`
+			}
+			if err := decoder.Decode(&msg); err != nil {
+				if ctx.Err() == nil {
+					errs <- fmt.Errorf("failed to read event: %w", err)
+				}
+				return
+			}
+
+			action := msg.Action
+			if mapped, ok := podmanActions[action]; ok {
+				action = mapped
+			}
+			exitCode, _ := strconv.Atoi(msg.Actor.Attributes["containerExitCode"])
+			select {
+			case result <- ContainerEvent{ID: msg.Actor.ID, Action: action, ExitCode: exitCode}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return result, errs
+}
+
+func (r *PodmanRuntime) Exec(ctx context.Context, id string, spec ExecSpec) (Stream, string, error) {
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := r.do(ctx, http.MethodPost, "/containers/"+id+"/exec", nil, map[string]any{
+		"AttachStdin":  true,
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Tty":          spec.Tty,
+		"Cmd":          spec.Cmd,
+		"Env":          spec.Env,
+		"User":         spec.User,
+		"WorkingDir":   spec.WorkingDir,
+	}, &created); err != nil {
+		return nil, "", fmt.Errorf("failed to create exec: %w", err)
+	}
+
+	stream, err := r.hijack(ctx, "/exec/"+created.ID+"/start", nil, map[string]any{
+		"Detach": false,
+		"Tty":    spec.Tty,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to attach to exec: %w", err)
+	}
+	return stream, created.ID, nil
+}
+
+func (r *PodmanRuntime) ExecExitCode(ctx context.Context, execID string) (int, error) {
+	var inspect struct {
+		ExitCode int `json:"ExitCode"`
+	}
+	if err := r.do(ctx, http.MethodGet, "/exec/"+execID+"/json", nil, nil, &inspect); err != nil {
+		return 0, fmt.Errorf("failed to inspect exec: %w", err)
+	}
+	return inspect.ExitCode, nil
+}
+
+func (r *PodmanRuntime) ResizeExec(ctx context.Context, execID string, height, width uint) error {
+	return r.do(ctx, http.MethodPost, "/exec/"+execID+"/resize", sizeQuery(height, width), nil, nil)
+}
+
+func (r *PodmanRuntime) CreateVolume(ctx context.Context, spec VolumeSpec) error {
+	return r.do(ctx, http.MethodPost, "/volumes/create", nil, map[string]any{
+		"Name":    spec.Name,
+		"Driver":  spec.Driver,
+		"Options": spec.DriverOpts,
+		"Label":   spec.Labels,
+	}, nil)
+}
+
+func (r *PodmanRuntime) VolumeExists(ctx context.Context, name string) (bool, error) {
+	return r.exists(ctx, "/volumes/"+name+"/exists")
+}
+
+func (r *PodmanRuntime) RemoveVolume(ctx context.Context, name string) error {
+	return r.do(ctx, http.MethodDelete, "/volumes/"+name, url.Values{
+		"force": {"true"},
+	}, nil, nil)
+}
+
+// podmanStream is a hijacked connection of the libpod API
+type podmanStream struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (s *podmanStream) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
+}
+
+func (s *podmanStream) Write(p []byte) (int, error) {
+	return s.conn.Write(p)
+}
+
+func (s *podmanStream) CloseWrite() error {
+	if conn, ok := s.conn.(interface{ CloseWrite() error }); ok {
+		return conn.CloseWrite()
+	}
+	return s.conn.Close()
+}
+
+func (s *podmanStream) Close() error {
+	return s.conn.Close()
+}
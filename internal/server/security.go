@@ -0,0 +1,134 @@
+package server
+
+import (
+	"embed"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed seccomp/*.json apparmor/*
+var securityFiles embed.FS
+
+// SecurityProfile restricts the system calls and file access of user containers
+type SecurityProfile struct {
+	Name     string
+	Seccomp  []byte // seccomp profile in the Docker format, nil keeps the runtime default
+	AppArmor string // name of the AppArmor profile, empty keeps the runtime default
+}
+
+// securityProfiles are the built-in profiles. The default profile keeps the
+// profiles of the runtime, strict denies ptrace, mount and the kernel keyring,
+// debugging allows ptrace and disabling address randomization for gdb.
+var securityProfiles = map[string]struct{ seccomp, appArmor string }{
+	"default":   {},
+	"strict":    {seccomp: "seccomp/strict.json", appArmor: "sshcontainer-strict"},
+	"debugging": {seccomp: "seccomp/debugging.json"},
+}
+
+// LookupSecurityProfile returns the built-in profile with the name
+func LookupSecurityProfile(name string) (SecurityProfile, error) {
+	files, exists := securityProfiles[name]
+	if !exists {
+		names := make([]string, 0, len(securityProfiles))
+		for name := range securityProfiles {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return SecurityProfile{}, fmt.Errorf("unknown security profile %q, use one of %s", name, strings.Join(names, ", "))
+	}
+
+	profile := SecurityProfile{Name: name, AppArmor: files.appArmor}
+	if files.seccomp != "" {
+		data, err := securityFiles.ReadFile(files.seccomp)
+		if err != nil {
+			return profile, fmt.Errorf("failed to read seccomp profile: %w", err)
+		}
+		profile.Seccomp = data
+	}
+	return profile, nil
+}
+
+// securityProfile returns the profile of the catalog entry, or of the user's
+// resource profile if the entry does not set one
+func (cm *ContainerManager) securityProfile(entry CatalogEntry, limits Limits) (SecurityProfile, error) {
+	name := entry.SecurityProfile
+	if name == "" {
+		name = limits.SecurityProfile
+	}
+	profile, err := LookupSecurityProfile(name)
+	if err != nil {
+		return profile, err
+	}
+	if !cm.appArmor {
+		profile.AppArmor = ""
+	}
+	return profile, nil
+}
+
+// loadAppArmorProfiles loads the shipped AppArmor profiles into the kernel. It
+// returns false if AppArmor is not enabled on the host.
+func loadAppArmorProfiles(log *logrus.Logger) (bool, error) {
+	enabled, err := os.ReadFile("/sys/module/apparmor/parameters/enabled")
+	if err != nil || strings.TrimSpace(string(enabled)) != "Y" {
+		log.Info("AppArmor is not enabled, security profiles only apply seccomp")
+		return false, nil
+	}
+
+	entries, err := securityFiles.ReadDir("apparmor")
+	if err != nil {
+		return false, fmt.Errorf("failed to read AppArmor profiles: %w", err)
+	}
+	for _, entry := range entries {
+		data, err := securityFiles.ReadFile(path.Join("apparmor", entry.Name()))
+		if err != nil {
+			return false, fmt.Errorf("failed to read AppArmor profile: %w", err)
+		}
+
+		file, err := os.CreateTemp("", "apparmor-")
+		if err != nil {
+			return false, fmt.Errorf("failed to write AppArmor profile: %w", err)
+		}
+		_, err = file.Write(data)
+		file.Close()
+		if err == nil {
+			var output []byte
+			output, err = exec.Command("apparmor_parser", "-Kr", file.Name()).CombinedOutput()
+			if err != nil {
+				err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+			}
+		}
+		os.Remove(file.Name())
+		if err != nil {
+			return false, fmt.Errorf("failed to load AppArmor profile %s: %w", entry.Name(), err)
+		}
+		log.WithField("profile", entry.Name()).Info("Loaded AppArmor profile")
+	}
+	return true, nil
+}
+
+// writeSeccompProfiles stores the seccomp profiles in the directory for
+// runtimes which only read profiles from files
+func writeSeccompProfiles(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create seccomp profile directory: %w", err)
+	}
+	for name := range securityProfiles {
+		profile, err := LookupSecurityProfile(name)
+		if err != nil {
+			return err
+		}
+		if profile.Seccomp == nil {
+			continue
+		}
+		if err := os.WriteFile(path.Join(dir, name+".json"), profile.Seccomp, 0644); err != nil {
+			return fmt.Errorf("failed to write seccomp profile: %w", err)
+		}
+	}
+	return nil
+}
@@ -3,14 +3,14 @@ package server
 import (
 	"context"
 	"fmt"
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/charmbracelet/ssh"
 	"github.com/docker/docker/pkg/stdcopy"
@@ -20,29 +20,75 @@ import (
 
 type Server struct {
 	config     *Config
+	catalog    *ImageCatalog
+	policy     *Policy
 	containers *ContainerManager
+	proxy      *EgressProxy // nil if the egress proxy is disabled
+	dnsFilter  *DNSFilter   // nil if the DNS filter is disabled
+	history    *SessionHistory
 	log        *logrus.Logger
 }
 
 func New(config *Config, log *logrus.Logger) (*Server, error) {
-	containerManager, err := NewContainerManager(config, log)
+	catalog, err := LoadImageCatalog(config)
 	if err != nil {
 		return nil, err
 	}
 
+	policy, err := LoadPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+
+	containerManager, err := NewContainerManager(config, catalog, policy, log)
+	if err != nil {
+		return nil, err
+	}
+
+	var proxy *EgressProxy
+	if config.EgressProxyListen != "" {
+		proxy, err = NewEgressProxy(config, containerManager, log)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var dnsFilter *DNSFilter
+	if config.DNSFilterListen != "" {
+		dnsFilter, err = NewDNSFilter(config, containerManager, log)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &Server{
 		config:     config,
+		catalog:    catalog,
+		policy:     policy,
 		containers: containerManager,
+		proxy:      proxy,
+		dnsFilter:  dnsFilter,
+		history:    NewSessionHistory(),
 		log:        log,
 	}, nil
 }
 
 func (s *Server) authenticateUser(ctx ssh.Context, password string) bool {
+	ws, _, err := ParseLogin(ctx.User())
+	if err != nil {
+		s.log.WithFields(logrus.Fields{
+			"user":   ctx.User(),
+			"remote": ctx.RemoteAddr(),
+			"error":  err,
+		}).Warn("Rejected invalid login name")
+		return false
+	}
+
 	data := url.Values{
 		"grant_type":    {"password"},
 		"client_id":     {s.config.ClientID},
 		"client_secret": {s.config.ClientSecret},
-		"username":      {ctx.User()},
+		"username":      {ws.User},
 		"password":      {password},
 	}
 
@@ -64,44 +110,137 @@ func (s *Server) authenticateUser(ctx ssh.Context, password string) bool {
 		"success": success,
 	}).Info("Authentication attempt")
 
+	if success {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			s.log.WithError(err).WithField("user", ctx.User()).Warn("Failed to read token response")
+		}
+		ctx.SetValue(claimsContextKey, parseTokenResponse(body))
+	}
+
 	return success
 }
 
 func (s *Server) handleSession(sess ssh.Session) {
-	ctx := context.Background()
 	sessionID := sess.Context().Value(ssh.ContextKeySessionID).(string)
-	username := sess.User()
+	ctx := WithSession(context.Background(), sessionID, sessionClaims(sess.Context()))
 
 	log := s.log.WithFields(logrus.Fields{
-		"user":      username,
+		"user":      sess.User(),
 		"remote":    sess.RemoteAddr(),
 		"sessionID": sessionID,
 	})
 
+	ws, imageName, err := sessionWorkspace(sess)
+	if err != nil {
+		log.WithError(err).Warn("Invalid workspace")
+		fmt.Fprintf(sess.Stderr(), "%v\n", err)
+		sess.Exit(1)
+		return
+	}
+	username := ws.User
+	groups := sessionClaims(sess.Context()).Groups(s.config.OAuthGroupsClaim)
+
+	if cmd := sess.Command(); len(cmd) == 1 && cmd[0] == statsCommand {
+		log.Info("Showing workspace stats")
+		newline := "\n"
+		if _, _, isPty := sess.Pty(); isPty {
+			newline = "\r\n"
+		}
+		writeStats(sess, ws, s.containers.WorkspaceStats(ctx, ws), newline)
+		sess.Exit(0)
+		return
+	}
+
+	entry, err := s.catalog.Lookup(imageName, groups)
+	if err != nil {
+		log.WithError(err).Warn("Invalid image selection")
+		fmt.Fprintf(sess.Stderr(), "%v\n", err)
+		sess.Exit(1)
+		return
+	}
+
 	log.Info("Starting new session")
+	started := time.Now()
 
 	// Get PTY info if available
 	ptyReq, winCh, isPty := sess.Pty()
 
+	var window *windowWatcher
+	if isPty {
+		window = watchWindow(ptyReq.Window, winCh)
+	}
+
+	var input io.Reader = sess
+	if isPty && s.config.LoginMenu && len(sess.Command()) == 0 {
+		sessInput := newSessionInput(sess)
+		defer sessInput.Close()
+		input = sessInput.Reader(nil)
+
+		workspaces := s.loginMenuWorkspaces(ws)
+		images := s.loginMenuImages(groups, entry)
+		choice, err := runLoginMenu(sess, username, sessInput, window, []loginMenuSection{workspaces, images}, s.loginMenuInfo(username))
+		if err != nil {
+			log.WithError(err).Error("Failed to show login menu")
+			sess.Exit(1)
+			return
+		}
+		if choice == nil {
+			log.Info("User quit login menu")
+			sess.Exit(0)
+			return
+		}
+		ws = workspaces.Items[choice[0]].Workspace
+		entry = images.Items[choice[1]].Image
+		log = log.WithField("workspace", ws.Name)
+	}
+
 	// Get or create container for user
-	containerID, err := s.containers.GetOrCreateContainer(ctx, username, sess.Environ())
+	limits := s.policy.Resolve(ws.User, groups)
+	lease, entry, err := s.containers.GetOrCreateContainer(ctx, ws, entry, limits, sess.Environ())
 	if err != nil {
 		log.WithError(err).Error("Failed to get or create container")
 		sess.Exit(1)
 		return
 	}
-	defer s.containers.ReleaseContainer(username)
+	defer s.containers.ReleaseContainer(lease)
+	// recorded with the workspace chosen in the login menu
+	defer s.history.Start(username, &SessionRecord{
+		ID:        sessionID,
+		Workspace: ws,
+		Remote:    sess.RemoteAddr().String(),
+		Command:   sess.Command(),
+		Started:   started,
+	})()
+	// the lease expires if the connection is gone without the session ending
+	go s.containers.KeepAlive(sess.Context(), lease)
+	containerID := lease.ContainerID
+
+	if err := s.containers.RunHooks(ctx, HookSessionStarted, ws, containerID, entry); err != nil {
+		log.WithError(err).Error("Failed to start session")
+		sess.Exit(1)
+		return
+	}
+	// runs before the container is released
+	defer s.containers.RunHooks(ctx, HookSessionEnded, ws, containerID, entry)
+
+	notices, unsubscribe := s.containers.SubscribeNotices(ws)
+	defer unsubscribe()
+	writeNotice := func(notice string) {
+		fmt.Fprintf(sess.Stderr(), "\r\n*** %s ***\r\n", notice)
+	}
 
-	var stream types.HijackedResponse
+	var stream Stream
 	var execID string
 
-	// Attach to container
-	cmd := s.config.ContainerCMD
-	if len(sess.Command()) > 0 {
-		cmd = sess.Command()
+	env := sess.Environ()
+	if s.proxy != nil {
+		env = append(env, s.proxy.Env(ws)...)
 	}
-	// Execute specific command
-	stream, execID, err = s.containers.ExecInContainer(ctx, containerID, sess.Environ(), cmd, s.config.ContainerUser, isPty)
+
+	// Attach to container
+	// Execute specific command or the default command of the image
+	stream, execID, err = s.containers.ExecInContainer(ctx, containerID, env, sess.Command(), entry, isPty)
 	if err != nil {
 		log.WithError(err).Error("Failed to exec in container")
 		sess.Exit(1)
@@ -112,35 +251,20 @@ func (s *Server) handleSession(sess ssh.Session) {
 
 	// Handle window size changes if PTY was requested
 	if isPty {
-		go func() {
-			for win := range winCh {
-				var err error
-				if execID != "" {
-					err = s.containers.ResizeExec(ctx, execID, uint16(win.Height), uint16(win.Width))
-				} else {
-					err = s.containers.client.ContainerResize(ctx, containerID, container.ResizeOptions{
-						Height: uint(win.Height),
-						Width:  uint(win.Width),
-					})
-				}
-				if err != nil {
-					log.WithError(err).Error("Failed to resize")
-				}
+		resize := func(win ssh.Window) {
+			var err error
+			if execID != "" {
+				err = s.containers.ResizeExec(ctx, execID, uint16(win.Height), uint16(win.Width))
+			} else {
+				err = s.containers.ResizeContainer(ctx, containerID, uint16(win.Height), uint16(win.Width))
 			}
-		}()
+			if err != nil {
+				log.WithError(err).Error("Failed to resize")
+			}
+		}
 
 		// Set initial terminal size
-		if execID != "" {
-			err = s.containers.ResizeExec(ctx, execID, uint16(ptyReq.Window.Height), uint16(ptyReq.Window.Width))
-		} else {
-			err = s.containers.client.ContainerResize(ctx, containerID, container.ResizeOptions{
-				Height: uint(ptyReq.Window.Height),
-				Width:  uint(ptyReq.Window.Width),
-			})
-		}
-		if err != nil {
-			log.WithError(err).Error("Failed to set initial terminal size")
-		}
+		resize(window.Notify(resize))
 	}
 
 	// Setup I/O copying
@@ -148,35 +272,66 @@ func (s *Server) handleSession(sess ssh.Session) {
 	go func() {
 		var err error
 		if isPty {
-			_, err = io.Copy(sess, stream.Reader)
+			_, err = io.Copy(sess, stream)
 		} else {
-			_, err = stdcopy.StdCopy(sess, sess.Stderr(), stream.Reader)
+			_, err = stdcopy.StdCopy(sess, sess.Stderr(), stream)
 		}
 		outputErr <- err
 	}()
 
 	go func() {
 		defer stream.CloseWrite()
-		io.Copy(stream.Conn, sess)
+		io.Copy(stream, input)
 	}()
 
 	defer func() {
 		log.Info("Session ended")
 	}()
 	// Wait for either the session to end or an error to occur
-	select {
-	case err := <-outputErr:
-		if err != nil {
-			log.WithError(err).Error("Error in I/O copy")
-			sess.Exit(1)
+	for {
+		select {
+		case notice := <-notices:
+			writeNotice(notice)
+		case err := <-outputErr:
+			// the exec ends with the container, show why if the event is already there
+			select {
+			case notice := <-notices:
+				writeNotice(notice)
+			default:
+			}
+			if err != nil {
+				log.WithError(err).Error("Error in I/O copy")
+				sess.Exit(1)
+			}
+			return
+		case <-sess.Context().Done():
+			log.Info("Session timeout")
 			return
 		}
-	case <-sess.Context().Done():
-		log.Info("Session timeout")
-		return
 	}
 }
 
+// sessionWorkspace determines the workspace and image name from the login name or the env variables
+func sessionWorkspace(sess ssh.Session) (Workspace, string, error) {
+	ws, imageName, err := ParseLogin(sess.User())
+	if err != nil {
+		return ws, imageName, err
+	}
+
+	if name := envValue(sess.Environ(), ImageEnv); name != "" && imageName == "" {
+		imageName = name
+		if !workspaceRegex.MatchString(imageName) {
+			return ws, imageName, fmt.Errorf("invalid image name: %q", imageName)
+		}
+	}
+
+	if name := envValue(sess.Environ(), WorkspaceEnv); name != "" && !strings.Contains(sess.User(), "+") {
+		ws.Name = name
+		return ws, imageName, ws.Validate()
+	}
+	return ws, imageName, nil
+}
+
 func (s *Server) Run() error {
 	pemBytes, err := os.ReadFile(s.config.SSHHostKey)
 	if err != nil {
@@ -228,6 +383,22 @@ func (s *Server) Run() error {
 		os.Exit(0)
 	}()
 
+	if s.proxy != nil {
+		go func() {
+			if err := s.proxy.ListenAndServe(s.config.EgressProxyListen); err != nil {
+				s.log.WithError(err).Fatal("Egress proxy failed")
+			}
+		}()
+	}
+
+	if s.dnsFilter != nil {
+		go func() {
+			if err := s.dnsFilter.ListenAndServe(s.config.DNSFilterListen); err != nil {
+				s.log.WithError(err).Fatal("DNS filter failed")
+			}
+		}()
+	}
+
 	s.log.WithField("port", s.config.SSHPort).Info("Starting SSH server")
 	return server.ListenAndServe()
 }
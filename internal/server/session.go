@@ -0,0 +1,133 @@
+package server
+
+import (
+	"io"
+	"sync"
+
+	"github.com/charmbracelet/ssh"
+)
+
+// sessionInput reads a session's stdin in the background so that consumers
+// can be swapped (e.g. login menu -> container) without losing keystrokes.
+// Input a consumer received after it was cancelled goes to the next one.
+type sessionInput struct {
+	data      chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	mutex     sync.Mutex
+	pending   []byte // received but not consumed yet
+}
+
+func newSessionInput(r io.Reader) *sessionInput {
+	in := &sessionInput{data: make(chan []byte), done: make(chan struct{})}
+	go func() {
+		defer close(in.data)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				chunk := make([]byte, n)
+				copy(chunk, buf[:n])
+				select {
+				case in.data <- chunk:
+				case <-in.done:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return in
+}
+
+// Close stops the background reader once the session ends
+func (in *sessionInput) Close() {
+	in.closeOnce.Do(func() { close(in.done) })
+}
+
+// unread keeps input for the next consumer
+func (in *sessionInput) unread(chunk []byte) {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+	in.pending = append(in.pending, chunk...)
+}
+
+// Reader returns a reader that yields session input until done is closed.
+// A nil done channel never cancels.
+func (in *sessionInput) Reader(done <-chan struct{}) io.Reader {
+	return &sessionInputReader{in: in, done: done}
+}
+
+type sessionInputReader struct {
+	in   *sessionInput
+	done <-chan struct{}
+}
+
+func (r *sessionInputReader) Read(p []byte) (int, error) {
+	r.in.mutex.Lock()
+	if len(r.in.pending) > 0 {
+		n := copy(p, r.in.pending)
+		r.in.pending = r.in.pending[n:]
+		r.in.mutex.Unlock()
+		return n, nil
+	}
+	r.in.mutex.Unlock()
+
+	select {
+	case chunk, ok := <-r.in.data:
+		if !ok {
+			return 0, io.EOF
+		}
+		// both may have been ready, the input belongs to the next consumer
+		select {
+		case <-r.done:
+			r.in.unread(chunk)
+			return 0, io.EOF
+		default:
+		}
+		n := copy(p, chunk)
+		if n < len(chunk) {
+			r.in.unread(chunk[n:])
+		}
+		return n, nil
+	case <-r.done:
+		return 0, io.EOF
+	case <-r.in.done:
+		return 0, io.EOF
+	}
+}
+
+// windowWatcher tracks the current PTY window size and forwards changes to
+// whoever currently owns the terminal.
+type windowWatcher struct {
+	mutex  sync.Mutex
+	window ssh.Window
+	notify func(ssh.Window)
+}
+
+func watchWindow(initial ssh.Window, winCh <-chan ssh.Window) *windowWatcher {
+	w := &windowWatcher{window: initial}
+	go func() {
+		for win := range winCh {
+			w.mutex.Lock()
+			w.window = win
+			notify := w.notify
+			w.mutex.Unlock()
+			if notify != nil {
+				notify(win)
+			}
+		}
+	}()
+	return w
+}
+
+// Notify replaces the resize callback and returns the current window size
+// so that the caller can apply it initially.
+func (w *windowWatcher) Notify(fn func(ssh.Window)) ssh.Window {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.notify = fn
+	return w.window
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// statsCommand is answered by the server instead of running in the container
+const statsCommand = ":stats"
+
+const statsTimeout = 10 * time.Second
+
+// WorkspaceStats is the resource usage of a workspace and its container
+type WorkspaceStats struct {
+	Status    string          // see ContainerStatus
+	Container *ContainerStats // nil if the container is not running
+	StatsErr  error           // set if the runtime did not report stats
+	CPUs      float64         // CPU limit, 0 if unlimited
+	OOMKilled bool            // a process was killed since the container started
+	DiskUsed  uint64
+	DiskLimit uint64
+	DiskErr   error
+}
+
+// WorkspaceStats reads the usage of the workspace container from the runtime
+// and the disk usage from the quota. Limits the runtime does not report are
+// taken from the profile of the container.
+func (cm *ContainerManager) WorkspaceStats(ctx context.Context, ws Workspace) WorkspaceStats {
+	stats := WorkspaceStats{Status: cm.ContainerStatus(ws)}
+	stats.DiskUsed, stats.DiskLimit, stats.DiskErr = cm.QuotaUsage(ws)
+
+	cm.containersMutex.RLock()
+	ct, exists := cm.containers[ws.Key()]
+	cm.containersMutex.RUnlock()
+	if !exists {
+		return stats
+	}
+
+	ct.mutex.Lock()
+	id, state, resources := ct.ID, ct.State, ct.Limits.Resources
+	stats.OOMKilled = ct.oomKilled
+	ct.mutex.Unlock()
+
+	stats.CPUs = float64(resources.NanoCPUs) / 1e9
+	if state != "running" {
+		return stats
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, statsTimeout)
+	defer cancel()
+	usage, err := cm.runtime.ContainerStats(ctx, id)
+	if err != nil {
+		stats.StatsErr = err
+		return stats
+	}
+	if usage.MemoryLimitBytes == 0 && resources.MemoryBytes > 0 {
+		usage.MemoryLimitBytes = uint64(resources.MemoryBytes)
+	}
+	if usage.PidsLimit == 0 && resources.PidsLimit > 0 {
+		usage.PidsLimit = uint64(resources.PidsLimit)
+	}
+	stats.Container = &usage
+	return stats
+}
+
+// writeStats prints the usage for the stats command. Lines end with "\r\n" on
+// a PTY.
+func writeStats(w io.Writer, ws Workspace, stats WorkspaceStats, newline string) {
+	var b strings.Builder
+	line := func(format string, args ...any) {
+		fmt.Fprintf(&b, format, args...)
+		b.WriteString(newline)
+	}
+
+	line("Workspace %s of %s: %s", ws.Name, ws.User, stats.Status)
+	switch {
+	case stats.Container != nil:
+		c := stats.Container
+		line("  Memory:     %s", usageOf(c.MemoryBytes, c.MemoryLimitBytes, FormatSize))
+		cpu := fmt.Sprintf("%.2f CPUs", c.CPUPercent/100)
+		if stats.CPUs > 0 {
+			cpu = fmt.Sprintf("%.2f of %g CPUs (%.0f%%)", c.CPUPercent/100, stats.CPUs, c.CPUPercent/stats.CPUs)
+		}
+		line("  CPU:        %s", cpu)
+		line("  Processes:  %s", usageOf(c.Pids, c.PidsLimit, func(n uint64) string { return fmt.Sprint(n) }))
+		line("  Network:    %s received, %s sent", FormatSize(c.NetworkRxBytes), FormatSize(c.NetworkTxBytes))
+	case stats.StatsErr != nil:
+		line("  Container:  usage unavailable: %v", stats.StatsErr)
+	}
+
+	switch {
+	case errors.Is(stats.DiskErr, ErrUsageUnavailable):
+		line("  Disk:       usage unavailable, limit %s", FormatSize(stats.DiskLimit))
+	case stats.DiskErr != nil:
+		line("  Disk:       usage unavailable: %v", stats.DiskErr)
+	default:
+		line("  Disk:       %s", usageOf(stats.DiskUsed, stats.DiskLimit, FormatSize))
+	}
+
+	if stats.OOMKilled {
+		line("")
+		line("A process was killed because the container ran out of memory.")
+	}
+	io.WriteString(w, b.String())
+}
+
+// usageOf formats the usage with the share of the limit, a limit of 0 is unlimited
+func usageOf(used, limit uint64, format func(uint64) string) string {
+	if limit == 0 {
+		return fmt.Sprintf("%s (no limit)", format(used))
+	}
+	return fmt.Sprintf("%s of %s (%.0f%%)", format(used), format(limit), float64(used)/float64(limit)*100)
+}
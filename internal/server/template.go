@@ -0,0 +1,359 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// templateMarker records in the workspace which template version was seeded
+const templateMarker = ".sshcontainer-template"
+
+// templateState is the content of the marker file
+type templateState struct {
+	Version string            `json:"version"`
+	Files   map[string]string `json:"files"` // sha256 of every seeded file
+}
+
+// templateFunc is called for every directory, file and symlink of a template.
+// Content is only set for regular files.
+type templateFunc func(name string, mode fs.FileMode, link string, content io.Reader) error
+
+// walkTemplate calls fn for the entries of a template directory or a tarball
+// (.tar, .tar.gz or .tgz), parents before their children
+func walkTemplate(src string, fn templateFunc) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("failed to read template: %w", err)
+	}
+	if info.IsDir() {
+		return walkTemplateDir(src, fn)
+	}
+	return walkTemplateTar(src, fn)
+}
+
+func walkTemplateDir(src string, fn templateFunc) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(src, p)
+		if err != nil || name == "." {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return fn(name, info.Mode(), link, nil)
+		case info.Mode().IsRegular():
+			file, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			return fn(name, info.Mode(), "", file)
+		case info.IsDir():
+			return fn(name, info.Mode(), "", nil)
+		}
+		return nil
+	})
+}
+
+func walkTemplateTar(src string, fn templateFunc) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to read template: %w", err)
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(src, ".gz") || strings.HasSuffix(src, ".tgz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("failed to read template: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read template: %w", err)
+		}
+
+		name := path.Clean(header.Name)
+		if name == "." {
+			continue
+		}
+		if !fs.ValidPath(name) {
+			return fmt.Errorf("invalid path in template: %q", header.Name)
+		}
+
+		mode := header.FileInfo().Mode()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = fn(name, mode, "", nil)
+		case tar.TypeReg:
+			err = fn(name, mode, "", archive)
+		case tar.TypeSymlink:
+			err = fn(name, mode, header.Linkname, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// templateVersion hashes names, modes and contents of the template
+func templateVersion(src string) (string, error) {
+	h := sha256.New()
+	err := walkTemplate(src, func(name string, mode fs.FileMode, link string, content io.Reader) error {
+		fmt.Fprintf(h, "%s\x00%o\x00%s\x00", name, mode, link)
+		if content != nil {
+			_, err := io.Copy(h, content)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// parseOwner parses the owner of template files like "1000:1000"
+func parseOwner(value string) (int64, int64, error) {
+	uidValue, gidValue, ok := strings.Cut(value, ":")
+	uid, err := strconv.ParseInt(uidValue, 10, 64)
+	if err != nil || !ok || uid < 0 {
+		return 0, 0, fmt.Errorf("invalid template owner: %q", value)
+	}
+	gid, err := strconv.ParseInt(gidValue, 10, 64)
+	if err != nil || gid < 0 {
+		return 0, 0, fmt.Errorf("invalid template owner: %q", value)
+	}
+	return uid, gid, nil
+}
+
+// seedWorkspace copies the template of the entry into a new workspace. With
+// WORKSPACE_TEMPLATE_MERGE workspaces seeded from another template version get
+// the files that are missing or that the user has not changed since they were
+// seeded, everything else in the workspace is kept.
+func (cm *ContainerManager) seedWorkspace(user, userVFS string, entry CatalogEntry, created bool) error {
+	if entry.Template == "" || !created && !cm.config.WorkspaceTemplateMerge {
+		return nil
+	}
+
+	version, err := templateVersion(entry.Template)
+	if err != nil {
+		return err
+	}
+	state, err := readTemplateState(userVFS)
+	if err != nil {
+		return err
+	}
+	if state.Version == version {
+		return nil
+	}
+
+	uid, gid, err := parseOwner(entry.TemplateOwner)
+	if err != nil {
+		return err
+	}
+	uid, gid, err = cm.hostIDs(user, uid, gid)
+	if err != nil {
+		return err
+	}
+
+	seeded := 0
+	err = walkTemplate(entry.Template, func(name string, mode fs.FileMode, link string, content io.Reader) error {
+		if name == templateMarker {
+			return nil
+		}
+		target, err := workspacePath(userVFS, name, uid, gid)
+		if err != nil || target == "" {
+			return err
+		}
+
+		switch {
+		case mode.IsDir():
+			if err := os.Mkdir(target, mode.Perm()); os.IsExist(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			return os.Lchown(target, int(uid), int(gid))
+		case mode&fs.ModeSymlink != 0:
+			if _, err := os.Lstat(target); !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			return os.Lchown(target, int(uid), int(gid))
+		}
+
+		if info, err := os.Lstat(target); err == nil {
+			// keep files the user created or changed
+			if !info.Mode().IsRegular() || state.Files[name] == "" || fileHash(target) != state.Files[name] {
+				return nil
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		sum, err := writeTemplateFile(target, mode, content, uid, gid)
+		if err != nil {
+			return fmt.Errorf("failed to seed %s: %w", name, err)
+		}
+		state.Files[name] = sum
+		seeded++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to seed workspace: %w", err)
+	}
+
+	state.Version = version
+	if err := writeTemplateState(userVFS, state, uid, gid); err != nil {
+		return err
+	}
+
+	cm.log.WithFields(logrus.Fields{
+		"user":     user,
+		"userVFS":  userVFS,
+		"template": entry.Template,
+		"version":  version,
+		"files":    seeded,
+		"merged":   !created,
+	}).Info("Seeded workspace from template")
+	return nil
+}
+
+// workspacePath returns the path of the template entry in the workspace and
+// creates missing parents. It returns "" if a parent is no directory, so
+// symlinks the user placed in the workspace are never followed.
+func workspacePath(root, name string, uid, gid int64) (string, error) {
+	current := root
+	parts := strings.Split(name, "/")
+	for _, part := range parts[:len(parts)-1] {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(current, 0755); err != nil {
+				return "", err
+			}
+			if err := os.Lchown(current, int(uid), int(gid)); err != nil {
+				return "", err
+			}
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if !info.IsDir() {
+			return "", nil
+		}
+	}
+	return filepath.Join(root, name), nil
+}
+
+// writeTemplateFile writes the content to a new file and returns its sha256
+func writeTemplateFile(target string, mode fs.FileMode, content io.Reader, uid, gid int64) (string, error) {
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, mode.Perm())
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, h), content); err != nil {
+		return "", err
+	}
+	if err := file.Chown(int(uid), int(gid)); err != nil {
+		return "", err
+	}
+	// the umask and chown clear mode bits
+	if err := file.Chmod(mode.Perm() | mode&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileHash returns the sha256 of the file or "" if it cannot be read
+func fileHash(name string) string {
+	file, err := os.OpenFile(name, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readTemplateState reads the marker, workspaces without one were never seeded
+func readTemplateState(userVFS string) (templateState, error) {
+	state := templateState{Files: make(map[string]string)}
+	file, err := os.OpenFile(filepath.Join(userVFS, templateMarker), os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return state, fmt.Errorf("failed to read template marker: %w", err)
+	}
+	defer file.Close()
+
+	// a broken marker is treated like a missing one
+	if err := json.NewDecoder(file).Decode(&state); err != nil {
+		return templateState{Files: make(map[string]string)}, nil
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]string)
+	}
+	return state, nil
+}
+
+func writeTemplateState(userVFS string, state templateState, uid, gid int64) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(userVFS, templateMarker)
+	// the user may have replaced the marker with a symlink
+	if info, err := os.Lstat(target); err == nil && !info.Mode().IsRegular() {
+		if err := os.RemoveAll(target); err != nil {
+			return fmt.Errorf("failed to write template marker: %w", err)
+		}
+	}
+	if _, err := writeTemplateFile(target, 0644, strings.NewReader(string(data)), uid, gid); err != nil {
+		return fmt.Errorf("failed to write template marker: %w", err)
+	}
+	return nil
+}
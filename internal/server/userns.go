@@ -0,0 +1,178 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// IDMapping maps the user and group IDs 0 to Size-1 of a container to the host
+// IDs starting at HostID
+type IDMapping struct {
+	HostID int64
+	Size   int64
+}
+
+// UIDMap assigns every user a distinct range of subordinate host IDs. The
+// assignments are stored in a file, so users keep their range and the owners
+// of their workspace files across restarts.
+type UIDMap struct {
+	Users map[string]int64 `json:"users"` // map of user to range index
+
+	path  string
+	base  int64
+	size  int64
+	mutex sync.Mutex
+}
+
+// LoadUIDMap reads the assigned ranges, a missing file starts an empty map
+func LoadUIDMap(path string, base, size int64) (*UIDMap, error) {
+	if base <= 0 || size <= 0 {
+		return nil, fmt.Errorf("USERNS_UID_BASE and USERNS_UID_SIZE must be positive")
+	}
+
+	m := &UIDMap{
+		Users: make(map[string]int64),
+		path:  path,
+		base:  base,
+		size:  size,
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read uid map: %w", err)
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("failed to parse uid map: %w", err)
+	}
+	return m, nil
+}
+
+// Range returns the ID range of the user and assigns the next free one to new users
+func (m *UIDMap) Range(user string) (IDMapping, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	index, exists := m.Users[user]
+	if !exists {
+		for _, assigned := range m.Users {
+			index = max(index, assigned+1)
+		}
+		m.Users[user] = index
+		if err := m.save(); err != nil {
+			delete(m.Users, user)
+			return IDMapping{}, err
+		}
+	}
+	return IDMapping{HostID: m.base + index*m.size, Size: m.size}, nil
+}
+
+func (m *UIDMap) save() error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write uid map: %w", err)
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return fmt.Errorf("failed to write uid map: %w", err)
+	}
+	return nil
+}
+
+// chownWorkspace hands the workspace to the host ID the root user of the
+// container maps to. Workspaces created before the user got an ID range are
+// shifted into the range once.
+func (cm *ContainerManager) chownWorkspace(user, userVFS string) error {
+	var uid, gid int64
+	var mapping *IDMapping
+	switch {
+	case cm.uidMap != nil:
+		r, err := cm.uidMap.Range(user)
+		if err != nil {
+			return err
+		}
+		uid, gid, mapping = r.HostID, r.HostID, &r
+	case cm.runtimeInfo.Rootless:
+		uid, gid = int64(cm.runtimeInfo.UID), int64(cm.runtimeInfo.GID)
+	default:
+		return nil
+	}
+
+	info, err := os.Lstat(userVFS)
+	if err != nil {
+		return fmt.Errorf("failed to stat user VFS: %w", err)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int64(stat.Uid) == uid && int64(stat.Gid) == gid {
+		return nil
+	}
+
+	cm.log.WithField("userVFS", userVFS).WithField("uid", uid).Info("Changing owner of user VFS")
+	if mapping == nil {
+		return os.Lchown(userVFS, int(uid), int(gid))
+	}
+	return shiftOwnership(userVFS, *mapping)
+}
+
+// hostIDs maps a user and group ID of the container to the IDs owning the
+// files on the host
+func (cm *ContainerManager) hostIDs(user string, uid, gid int64) (int64, int64, error) {
+	switch {
+	case cm.uidMap != nil:
+		r, err := cm.uidMap.Range(user)
+		if err != nil {
+			return 0, 0, err
+		}
+		if uid >= r.Size || gid >= r.Size {
+			return 0, 0, fmt.Errorf("owner %d:%d is outside of the ID range of %s", uid, gid, user)
+		}
+		return r.HostID + uid, r.HostID + gid, nil
+	case cm.runtimeInfo.Rootless:
+		// only root of the container is known to map to the user of the engine
+		return int64(cm.runtimeInfo.UID), int64(cm.runtimeInfo.GID), nil
+	}
+	return uid, gid, nil
+}
+
+// shiftOwnership moves the owners of all files below root into the ID range.
+// Owners outside of the container ID range are kept.
+func shiftOwnership(root string, mapping IDMapping) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+
+		uid, gid := int64(stat.Uid), int64(stat.Gid)
+		if uid < mapping.Size {
+			uid += mapping.HostID
+		}
+		if gid < mapping.Size {
+			gid += mapping.HostID
+		}
+		if err := os.Lchown(path, int(uid), int(gid)); err != nil {
+			return fmt.Errorf("failed to change owner of %s: %w", path, err)
+		}
+		// chown clears the setuid and setgid bits
+		if mode := info.Mode(); mode&(fs.ModeSetuid|fs.ModeSetgid) != 0 && mode&fs.ModeSymlink == 0 {
+			return os.Chmod(path, mode)
+		}
+		return nil
+	})
+}
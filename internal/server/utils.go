@@ -52,3 +52,30 @@ func ParseSize(size string) (uint64, error) {
 
 	return uint64(bytes), nil
 }
+
+// FormatSize converts a byte count to a human-readable size string (e.g. "1.5G")
+func FormatSize(bytes uint64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+
+	value := float64(bytes)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", bytes, units[unit])
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+// envValue returns the value of key in a list of KEY=value entries
+func envValue(env []string, key string) string {
+	for _, entry := range env {
+		if k, v, ok := strings.Cut(entry, "="); ok && k == key {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultWorkspace is used when the user does not select a workspace
+	DefaultWorkspace = "default"
+	// WorkspaceEnv selects a workspace if none is given in the login name
+	WorkspaceEnv = "SSHCONTAINER_WORKSPACE"
+
+	vfsRoot            = "/mnt/vfs"
+	workspaceSeparator = "__"
+)
+
+var (
+	usernameRegex  = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+	workspaceRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+)
+
+// Workspace identifies one environment of a user. Every workspace gets its
+// own container, volume and VFS subvolume.
+type Workspace struct {
+	User string
+	Name string
+}
+
+// ParseLogin splits a login name like "alice+projectx:python" into the
+// workspace and the optional image catalog entry name
+func ParseLogin(login string) (Workspace, string, error) {
+	login, image, _ := strings.Cut(login, ":")
+	user, name, _ := strings.Cut(login, "+")
+	ws := Workspace{User: user, Name: name}
+	if ws.Name == "" {
+		ws.Name = DefaultWorkspace
+	}
+	if image != "" && !workspaceRegex.MatchString(image) {
+		return ws, image, fmt.Errorf("invalid image name: %q", image)
+	}
+	return ws, image, ws.Validate()
+}
+
+func (w Workspace) Validate() error {
+	if !usernameRegex.MatchString(w.User) || strings.Contains(w.User, workspaceSeparator) {
+		return fmt.Errorf("invalid username: %q", w.User)
+	}
+	if !workspaceRegex.MatchString(w.Name) {
+		return fmt.Errorf("invalid workspace name: %q", w.Name)
+	}
+	return nil
+}
+
+// IsDefault reports whether this is the user's default workspace
+func (w Workspace) IsDefault() bool {
+	return w.Name == "" || w.Name == DefaultWorkspace
+}
+
+// Key is the unique name of the workspace used for containers, volumes and subvolumes.
+// The default workspace keeps the plain username for backwards compatibility.
+func (w Workspace) Key() string {
+	if w.IsDefault() {
+		return w.User
+	}
+	return w.User + workspaceSeparator + w.Name
+}
+
+func (w Workspace) String() string {
+	if w.IsDefault() {
+		return w.User
+	}
+	return w.User + "+" + w.Name
+}
+
+// ContainerName returns the name of the workspace container of the server instance
+func (w Workspace) ContainerName(instance string) string {
+	return namePrefix(instance) + w.Key()
+}
+
+// VolumeName returns the name of the workspace volume of the server instance
+func (w Workspace) VolumeName(instance string) string {
+	return namePrefix(instance) + "vfs-" + w.Key()
+}
+
+// WorkspaceFromLabels restores the workspace of a container from its labels
+func WorkspaceFromLabels(labels map[string]string) Workspace {
+	ws := Workspace{
+		User: labels["de.mc8051.sshcontainer.user"],
+		Name: labels["de.mc8051.sshcontainer.workspace"],
+	}
+	if ws.Name == "" {
+		ws.Name = DefaultWorkspace
+	}
+	return ws
+}
+
+// ListWorkspaces returns all workspaces of the user that have a VFS subvolume
+// in the directory
+func ListWorkspaces(dir, user string) ([]Workspace, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []Workspace{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read VFS root: %w", err)
+	}
+
+	workspaces := make([]Workspace, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if entry.Name() == user {
+			workspaces = append(workspaces, Workspace{User: user, Name: DefaultWorkspace})
+		} else if name, ok := strings.CutPrefix(entry.Name(), user+workspaceSeparator); ok {
+			// the directory alice___x of the user alice_ would be the workspace
+			// _x of alice, names starting with the separator are invalid
+			if workspaceRegex.MatchString(name) {
+				workspaces = append(workspaces, Workspace{User: user, Name: name})
+			}
+		}
+	}
+
+	sortWorkspaces(workspaces)
+	return workspaces, nil
+}
+
+// sortWorkspaces orders the default workspace first and the others by name
+func sortWorkspaces(workspaces []Workspace) {
+	sort.Slice(workspaces, func(i, j int) bool {
+		if workspaces[i].IsDefault() != workspaces[j].IsDefault() {
+			return workspaces[i].IsDefault()
+		}
+		return workspaces[i].Name < workspaces[j].Name
+	})
+}